@@ -0,0 +1,58 @@
+package quic
+
+import (
+	"compress/flate"
+	"io"
+)
+
+// Compression codecs, for use with OptionCompression
+const (
+	CodecFlate = "flate"
+)
+
+// codecs maps the name of each supported codec to a function that wraps a
+// stream in it.
+var codecs = map[string]func(io.ReadWriteCloser) io.ReadWriteCloser{
+	CodecFlate: newFlateStream,
+}
+
+// pickCodec returns the first of the offered codecs that is also accepted, or
+// the empty string if there is none.  The dialer's preference order wins.
+func pickCodec(offered, accepted []string) string {
+	for _, o := range offered {
+		for _, a := range accepted {
+			if o == a {
+				return o
+			}
+		}
+	}
+	return ""
+}
+
+// flateStream compresses a stream with DEFLATE.  Every write is flushed, so
+// that messages are delivered as soon as they are sent.
+type flateStream struct {
+	io.Closer
+	r io.ReadCloser
+	w *flate.Writer
+}
+
+func newFlateStream(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	w, _ := flate.NewWriter(rwc, flate.DefaultCompression) // only fails on bad level
+	return &flateStream{Closer: rwc, r: flate.NewReader(rwc), w: w}
+}
+
+func (f *flateStream) Read(b []byte) (int, error) { return f.r.Read(b) }
+
+func (f *flateStream) Write(b []byte) (n int, err error) {
+	if n, err = f.w.Write(b); err == nil {
+		err = f.w.Flush()
+	}
+	return
+}
+
+func (f *flateStream) Close() error {
+	_ = f.w.Close() // best-effort; terminates the DEFLATE stream
+	_ = f.r.Close()
+	return f.Closer.Close()
+}
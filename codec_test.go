@@ -0,0 +1,49 @@
+package quic
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestPickCodec(t *testing.T) {
+	for _, tc := range []struct {
+		offered, accepted []string
+		want              string
+	}{
+		{nil, []string{CodecFlate}, ""},
+		{[]string{CodecFlate}, nil, ""},
+		{[]string{"zstd", CodecFlate}, []string{CodecFlate, "zstd"}, "zstd"},
+		{[]string{"zstd", CodecFlate}, []string{CodecFlate}, CodecFlate},
+	} {
+		if got := pickCodec(tc.offered, tc.accepted); got != tc.want {
+			t.Errorf("pickCodec(%v, %v): expected `%s`, got `%s`", tc.offered, tc.accepted, tc.want, got)
+		}
+	}
+}
+
+func TestFlateStream(t *testing.T) {
+	buf := &bufCloser{Buffer: new(bytes.Buffer)}
+	z := newFlateStream(buf)
+
+	msg := bytes.Repeat([]byte("mangos "), 64)
+	if _, err := z.Write(msg); err != nil {
+		t.Fatal(err)
+	} else if buf.Len() >= len(msg) {
+		t.Errorf("expected fewer than %d bytes on the wire, got %d", len(msg), buf.Len())
+	}
+
+	// each write is flushed, so it can be read back without closing
+	b := make([]byte, len(msg))
+	if _, err := io.ReadFull(z, b); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(b, msg) {
+		t.Errorf("expected %s, got %s", msg, b)
+	}
+
+	if err := z.Close(); err != nil {
+		t.Error(err)
+	} else if !buf.closed {
+		t.Error("stream not closed")
+	}
+}
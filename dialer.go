@@ -1,9 +1,12 @@
 package quic
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
+	"net/url"
+	"time"
 
 	"github.com/SentimensRG/ctx"
 	quic "github.com/lucas-clemente/quic-go"
@@ -11,62 +14,465 @@ import (
 	"github.com/pkg/errors"
 )
 
+// maxRedirects bounds the number of redirects followed by a single dial
+const maxRedirects = 5
+
+type sessFactory func(context.Context, string, *tls.Config, *quic.Config) (quic.Session, error)
+
+type connSessFactory func(context.Context, net.PacketConn, net.Addr, string, *tls.Config, *quic.Config) (quic.Session, error)
+
+// poolCfg bounds the sessions dialed to a single peer, and decides which of them
+// carries each new path
+type poolCfg struct {
+	max    int
+	policy SessionPolicy
+}
+
 type dialMux struct {
-	mux  dialMuxer
-	sess *refcntSession
-	sock mangos.Socket
+	mux     dialMuxer
+	factory sessFactory
+	dialer  connSessFactory // dials from the shared socket bound to local
+	pool    poolCfg
+	reverse bool          // only open streams on sessions accepted from the peer
+	local   string        // dial from the transport's socket bound to this address
+	timeout time.Duration // bounds each call to Dial, see OptionDialTimeout
+	expires time.Time     // deadline of the current call to Dial, if any
+	moved   Redirect      // target of the permanent redirects followed so far
+	n       netlocator
+	sess    *refcntSession
+	sock    mangos.Socket
+	tc      *tls.Config
+	qc      *quic.Config
 }
 
 func newDialMux(sock mangos.Socket, m dialMuxer) *dialMux {
-	return &dialMux{sock: sock, mux: m}
+	return &dialMux{
+		sock:    sock,
+		mux:     m,
+		factory: m.DialAddr,
+		dialer:  quic.DialContext,
+		pool:    poolCfg{max: 1, policy: PolicyFill},
+	}
+}
+
+func (dm *dialMux) LoadSession(n netlocator, tc *tls.Config, qc *quic.Config) (err error) {
+	dm.n, dm.tc, dm.qc = n, tc, qc
+	dm.sess, err = dm.loadSession(n)
+	return
 }
 
-func (dm *dialMux) LoadSession(n netlocator, tc *tls.Config, qc *quic.Config) error {
+// slotKey returns the key under which the i-th session of the pool identified
+// by key is stored.  The first session is stored under the pool's key itself.
+func slotKey(key string, i int) string {
+	if i == 0 {
+		return key
+	}
+	return fmt.Sprintf("%s#%d", key, i)
+}
+
+// loadSession returns a session from the pool for n, dialing one if the pool's
+// policy calls for it, with its reference count incremented on behalf of the
+// caller.
+func (dm *dialMux) loadSession(n netlocator) (*refcntSession, error) {
+	if dm.reverse {
+		return dm.inboundSession(n)
+	}
+
+	key, err := sessionKey(dm.mux, n, dm.tc, dm.local)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		dm.mux.Lock()
+
+		var (
+			sess    *refcntSession
+			free    = -1
+			pending <-chan struct{} // a slot being dialed by someone else
+		)
+
+		for i := 0; i < dm.pool.max; i++ {
+			s, ok := dm.mux.GetSession(slotKey(key, i))
+			if !ok {
+				if ch := dm.mux.Dialing(slotKey(key, i)); ch != nil {
+					pending = ch
+				} else if free < 0 {
+					free = i
+				}
+			} else if sess == nil || (dm.pool.policy == PolicySpread && s.load() < sess.load()) {
+				sess = s
+			}
+		}
+
+		switch {
+		case free >= 0 && (sess == nil || dm.pool.policy == PolicySpread):
+			dm.mux.ReserveSlot(slotKey(key, free))
+			dm.mux.Unlock()
+			return dm.dialSlot(n, slotKey(key, free))
+		case sess != nil:
+			sess.Incr()
+			dm.mux.Unlock()
+			return sess, nil
+		}
+		dm.mux.Unlock()
+
+		// Every slot of the pool is being dialed, so wait for one of them
+		if err = dm.await(pending); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// await waits for ready to be closed, until the current call to Dial expires
+func (dm *dialMux) await(ready <-chan struct{}) error {
+	dctx, cancel := dm.dialContext()
+	defer cancel()
+
+	select {
+	case <-ready:
+		return nil
+	case <-dctx.Done():
+		return &TimeoutError{Op: "dial", After: dm.timeout}
+	}
+}
+
+// inboundSession returns the session accepted from the peer at n, with its
+// reference count incremented on behalf of the caller.  It fails if the peer
+// has not connected to one of our listeners, since it cannot be dialed.
+func (dm *dialMux) inboundSession(n netlocator) (*refcntSession, error) {
+	key, err := sessionKey(dm.mux, n, nil, "") // inbound sessions are keyed by remote address
+	if err != nil {
+		return nil, err
+	}
+
+	dm.mux.Lock()
+	defer dm.mux.Unlock()
+
+	sess, ok := dm.mux.GetInbound(key)
+	if !ok {
+		return nil, errors.Errorf("no inbound session from %s", n.Netloc())
+	}
+	return sess.Incr(), nil
+}
+
+// dialSlot dials a new session for n and stores it under key, which the caller
+// reserved with ReserveSlot.  The handshake runs without the multiplexer's lock,
+// so that a slow peer does not hold up the rest of the transport.  The session
+// is returned with its reference count incremented on behalf of the caller.
+func (dm *dialMux) dialSlot(n netlocator, key string) (*refcntSession, error) {
+	dctx, cancel := dm.dialContext()
+	qs, err := dm.dialSession(dctx, n)
+	expired := dctx.Err() == context.DeadlineExceeded
+	cancel()
+
 	dm.mux.Lock()
 	defer dm.mux.Unlock()
+	defer dm.mux.ReleaseSlot(key)
+
+	if err != nil && expired {
+		return nil, &TimeoutError{Op: "dial", After: dm.timeout}
+	} else if isTimeout(err) {
+		return nil, &TimeoutError{Op: "handshake", After: handshakeTimeout(dm.qc)}
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Init refcnt to track the Session's usage and clean up when we're done
+	sess := newRefCntSession(qs, key, dm.mux)
+	dm.mux.AddSession(key, sess.Incr()) // don't add until it's incremented
+	sess.open()
+
+	// Don't hand out the session once it's closed, e.g. because the peer went
+	// away, even if some streams still hold a reference to it.
+	ctx.Defer(qs.Context(), func() { dm.mux.DelSession(sess) })
+	return sess, nil
+}
+
+// dialContext returns the context of a session dial, which expires with the
+// current call to Dial
+func (dm *dialMux) dialContext() (context.Context, context.CancelFunc) {
+	if dm.expires.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), dm.expires)
+}
 
-	var ok bool
-	if dm.sess, ok = dm.mux.GetSession(n); !ok {
+// handshakeTimeout returns the handshake timeout set in qc, if any
+func handshakeTimeout(qc *quic.Config) time.Duration {
+	if qc == nil {
+		return 0
+	}
+	return qc.HandshakeTimeout
+}
+
+// dialSession dials a session to n, from the transport's shared socket bound to
+// dm.local if set, which is released once the session is closed.  The caller
+// must not hold the multiplexer's lock.
+func (dm *dialMux) dialSession(dctx context.Context, n netlocator) (quic.Session, error) {
+	if dm.local == "" {
+		return dm.factory(dctx, n.Netloc(), dm.tc, dm.qc)
+	}
+
+	raddr, err := dm.mux.ResolveAddr(n.Netloc())
+	if err != nil {
+		return nil, err
+	}
+
+	dm.mux.Lock()
+	c, err := dm.mux.LoadConn(dm.local)
+	dm.mux.Unlock()
+	if err != nil {
+		return nil, errors.Wrap(err, "shared socket")
+	}
+
+	qs, err := dm.dialer(dctx, c, raddr, n.Netloc(), dm.tc, dm.qc)
+	if err != nil {
+		dm.mux.Lock()
+		_ = dm.mux.ReleaseConn(c)
+		dm.mux.Unlock()
+		return nil, err
+	}
+
+	ctx.Defer(qs.Context(), func() {
+		dm.mux.Lock()
+		_ = dm.mux.ReleaseConn(c)
+		dm.mux.Unlock()
+	})
+	return qs, nil
+}
 
-		// We don't have a session for this [ ??? ] yet, so create it
-		qs, err := quic.DialAddr(n.Netloc(), tc, qc)
-		if err != nil {
-			return err
+// Dial negotiates a stream for req on the session loaded by LoadSession,
+// following any redirects issued by the listener.  Redirects are remembered in
+// dm.moved for as long as they are permanent, starting from the first hop.
+func (dm *dialMux) Dial(req request, timeout time.Duration) (net.Conn, error) {
+	// LoadSession took a reference on our behalf, which we hold until we are
+	// done.  Each attempt takes its own, which lives as long as its stream.
+	sess, n := dm.sess, dm.n
+	defer func() { _ = sess.DecrAndClose() }()
+
+	permanent := true
+	for hops, retried := 0, false; ; hops++ {
+		c, err := dm.dial(sess.Incr(), n, req, timeout)
+
+		// The listener closed the session to shut down gracefully.  Its peers
+		// may have taken over, so try once more on a fresh session.
+		if isGoingAway(err) {
+			if dm.mux.DelSession(sess); retried || dm.reverse {
+				return nil, errors.Wrap(ErrGoingAway, err.Error())
+			}
+
+			next, err := dm.loadSession(n)
+			if err != nil {
+				return nil, errors.Wrap(err, "redial")
+			}
+
+			_ = sess.DecrAndClose()
+			sess, retried = next, true
+			continue
+		}
+
+		rd, ok := errors.Cause(err).(*Redirect)
+		if !ok {
+			return c, err
+		} else if hops == maxRedirects {
+			return nil, errors.Wrapf(ErrTooManyRedirects, "after %d hops", hops)
+		}
+
+		if permanent = permanent && rd.code() == StatusMovedPermanently; permanent {
+			dm.moved.Code = StatusMovedPermanently
+			if rd.Netloc != "" {
+				dm.moved.Netloc = rd.Netloc
+			}
+			if rd.Path != "" {
+				dm.moved.Path = rd.Path
+			}
+		}
+
+		if rd.Path != "" {
+			req.path = rd.Path
+		}
+
+		if rd.Netloc != "" {
+			n = netloc{&url.URL{Host: rd.Netloc}}
+			next, err := dm.loadSession(n)
+			if err != nil {
+				return nil, errors.Wrapf(err, "follow redirect to %s", rd.Netloc)
+			}
+
+			_ = sess.DecrAndClose()
+			sess = next
+		}
+	}
+}
+
+// openStream opens a stream on sess, whose reference is handed over to the
+// stream.  If sess has no stream to spare, the stream is opened on another
+// session of the pool for n instead, dialing one if the pool has room.  Only
+// once the pool is full do we wait for a stream to free up on sess, until the
+// dial expires.
+func (dm dialMux) openStream(sess *refcntSession, n netlocator) (*refcntSession, quic.Stream, error) {
+	stream, err := sess.OpenStream()
+	if isSaturated(err) {
+		if next, s := dm.overflow(sess, n); next != nil {
+			_ = sess.DecrAndClose()
+			return next, s, nil
+		}
+		stream, err = dm.openStreamSync(sess)
+	}
+
+	if err != nil {
+		_ = sess.DecrAndClose()
+	}
+	return sess, stream, err
+}
+
+// openStreamSync waits for a stream to free up on sess, until dm.expires.  A
+// stream opened once we gave up is closed.
+func (dm dialMux) openStreamSync(sess *refcntSession) (quic.Stream, error) {
+	if dm.expires.IsZero() {
+		return sess.OpenStreamSync()
+	}
+
+	type opened struct {
+		stream quic.Stream
+		err    error
+	}
+
+	ch := make(chan opened, 1)
+	go func() {
+		stream, err := sess.OpenStreamSync()
+		ch <- opened{stream, err}
+	}()
+
+	dctx, cancel := dm.dialContext()
+	defer cancel()
+
+	select {
+	case o := <-ch:
+		return o.stream, o.err
+	case <-dctx.Done():
+		go func() {
+			if o := <-ch; o.err == nil {
+				_ = o.stream.Close()
+			}
+		}()
+		return nil, &TimeoutError{Op: "dial", After: dm.timeout}
+	}
+}
+
+// overflow opens a stream on any session of the pool for n other than the
+// saturated one, dialing a new session if needed.  The session is returned
+// with its reference count incremented on behalf of the stream, or nil if no
+// stream could be opened.
+func (dm dialMux) overflow(saturated *refcntSession, n netlocator) (*refcntSession, quic.Stream) {
+	key, err := sessionKey(dm.mux, n, dm.tc, dm.local)
+	if err != nil {
+		return nil, nil
+	}
+
+	dm.mux.Lock()
+
+	free := -1
+	for i := 0; i < dm.pool.max; i++ {
+		s, ok := dm.mux.GetSession(slotKey(key, i))
+		if !ok {
+			if free < 0 && dm.mux.Dialing(slotKey(key, i)) == nil {
+				free = i
+			}
+		} else if s != saturated {
+			if stream, err := s.OpenStream(); err == nil {
+				s.Incr()
+				dm.mux.Unlock()
+				return s, stream
+			}
 		}
+	}
+
+	if free < 0 {
+		dm.mux.Unlock()
+		return nil, nil
+	}
+
+	dm.mux.ReserveSlot(slotKey(key, free))
+	dm.mux.Unlock()
 
-		// Init refcnt to track the Session's usage and clean up when we're done
-		dm.sess = newRefCntSession(qs, dm.mux)
-		dm.mux.AddSession(qs.RemoteAddr(), dm.sess) // don't add until it's incremented
+	s, err := dm.dialSlot(n, slotKey(key, free))
+	if err != nil {
+		return nil, nil
 	}
 
-	dm.sess.Incr()
-	return nil
+	stream, err := s.OpenStream()
+	if err != nil {
+		_ = s.DecrAndClose()
+		return nil, nil
+	}
+	return s, stream
 }
 
-func (dm dialMux) Dial(path string) (net.Conn, error) {
-	stream, err := dm.sess.OpenStreamSync()
+func (dm dialMux) dial(sess *refcntSession, peer netlocator, req request, timeout time.Duration) (net.Conn, error) {
+	sess, stream, err := dm.openStream(sess, peer)
 	if err != nil {
 		return nil, errors.Wrap(err, "open stream")
 	}
 
 	// There's no Close method for mangos.PipeDialer, so we need to decr
 	// the ref counter when the stream closes.
-	ctx.Defer(stream.Context(), func() { _ = dm.sess.DecrAndClose() })
+	ctx.Defer(stream.Context(), func() { _ = sess.DecrAndClose() })
 
 	// this is where we do the path negotiation
 	var n dialNegotiator = newNegotiator(stream)
 
-	if err = n.WriteHeaders(fmt.Sprintf("%s\n", path)); err != nil {
+	// The negotiation must complete within its own timeout, and within the
+	// dial's, whichever expires first.
+	deadline := dm.expires
+	if timeout > 0 {
+		if d := time.Now().Add(timeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	if !deadline.IsZero() {
+		_ = stream.SetDeadline(deadline)
+	}
+
+	if err = n.WriteHeaders(req); err != nil {
 		_ = stream.Close()
 		return nil, errors.Wrap(err, "write headers")
 	}
-	if err = n.Ack(); err != nil {
+	resp, err := n.Ack()
+	if isTimeout(err) && dm.expired() {
+		err = &TimeoutError{Op: "dial", After: dm.timeout}
+	} else if isTimeout(err) {
+		err = &NegotiationError{Code: StatusTimeout, Message: "timed out awaiting ack"}
+	}
+	if err != nil {
+		_ = stream.Close()
 		return nil, errors.Wrap(err, "ack")
 	}
 
-	return &conn{Stream: stream, Session: dm.sess}, nil
+	c := &conn{Stream: stream, Session: sess}
+	if req.proto != nil && resp.proto != nil {
+		if !req.proto.compatible(*resp.proto) {
+			_ = stream.Close()
+			return nil, errors.Wrap(ErrProtocolMismatch, "ack")
+		}
+		c.peer = resp.proto
+	}
+
+	if resp.codec != "" && pickCodec(req.codecs, []string{resp.codec}) == "" {
+		_ = stream.Close()
+		return nil, errors.Errorf("ack: listener picked unoffered codec %s", resp.codec)
+	}
+
+	_ = stream.SetDeadline(time.Time{})
+	c.compress(resp.codec)
+	sess.track(req.path, stream)
+	return c, nil
 }
 
+// expired reports whether the current call to Dial is past its deadline
+func (dm dialMux) expired() bool { return !dm.expires.IsZero() && !time.Now().Before(dm.expires) }
+
 type dialer struct {
 	netloc
 	*dialMux
@@ -76,17 +482,39 @@ type dialer struct {
 
 func (d dialer) Dial() (mangos.Pipe, error) {
 	tc, qc := getQUICCfg(d.opt)
+	d.pool = getPoolCfg(d.opt)
+	d.reverse = getReverse(d.opt)
+	d.local = getLocalAddr(d.opt)
+
+	d.expires = time.Time{}
+	if d.timeout = getDialTimeout(d.opt); d.timeout > 0 {
+		d.expires = time.Now().Add(d.timeout)
+	}
+
+	// Go straight to where we were permanently redirected before
+	n, path := d.netloc, d.Path
+	if d.moved.Netloc != "" {
+		n = netloc{&url.URL{Host: d.moved.Netloc, Path: path}}
+	}
+	if d.moved.Path != "" {
+		path = d.moved.Path
+	}
 
-	if err := d.LoadSession(d.netloc, tc, qc); err != nil {
+	if err := d.LoadSession(n, tc, qc); err != nil {
 		return nil, errors.Wrap(err, "dial quic")
 	}
 
-	conn, err := d.dialMux.Dial(d.Path)
+	conn, err := d.dialMux.Dial(request{
+		path:    path,
+		headers: getHeaders(d.opt),
+		proto:   sockProto(d.sock),
+		codecs:  getCompression(d.opt),
+	}, getNegotiationTimeout(d.opt))
 	if err != nil {
 		return nil, errors.Wrap(err, "dial path")
 	}
 
-	return mangos.NewConnPipe(conn, d.sock)
+	return newPipe(conn, d.sock)
 }
 
 func (d dialer) GetOption(name string) (interface{}, error) { return d.opt.get(name) }
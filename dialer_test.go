@@ -0,0 +1,482 @@
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	quic "github.com/lucas-clemente/quic-go"
+	"github.com/pkg/errors"
+)
+
+func TestSessionKey(t *testing.T) {
+	byName, err := sessionKey(udpNetwork{}, mockAddrNetloc("localhost:9001"), nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byIP, err := sessionKey(udpNetwork{}, mockAddrNetloc("127.0.0.1:9001"), &tls.Config{}, "")
+	if err != nil {
+		t.Fatal(err)
+	} else if byName != byIP {
+		t.Errorf("expected %s, got %s", byName, byIP)
+	}
+
+	if k, _ := sessionKey(udpNetwork{}, mockAddrNetloc("127.0.0.1:9001"), &tls.Config{ServerName: "a"}, ""); k == byIP {
+		t.Error("server name not part of session key")
+	}
+
+	if k, _ := sessionKey(udpNetwork{}, mockAddrNetloc("127.0.0.1:9001"), nil, "localhost:9002"); k == byIP {
+		t.Error("local address not part of session key")
+	} else if k2, _ := sessionKey(udpNetwork{}, mockAddrNetloc("127.0.0.1:9001"), nil, "127.0.0.1:9002"); k2 != k {
+		t.Errorf("expected %s, got %s", k, k2)
+	}
+
+	if _, err := sessionKey(udpNetwork{}, mockAddrNetloc("127.0.0.1"), nil, ""); err == nil {
+		t.Error("expected error for missing port")
+	}
+}
+
+func TestDialMux(t *testing.T) {
+	t.Run("LoadSession", func(t *testing.T) {
+		var dials int
+		dm := newDialMux(nil, newMux())
+		dm.factory = func(context.Context, string, *tls.Config, *quic.Config) (quic.Session, error) {
+			dials++
+			return &mockSess{}, nil
+		}
+
+		for _, addr := range []string{
+			"quic://localhost:9001/a",
+			"quic://localhost:9001/b",
+			"quic://127.0.0.1:9001/c",
+		} {
+			u, _ := url.Parse(addr)
+			if err := dm.LoadSession(netloc{u}, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if dials != 1 {
+			t.Errorf("expected 1 session, dialed %d", dials)
+		} else if dm.sess.refcnt != 3 {
+			t.Errorf("expected 3 references, got %d", dm.sess.refcnt)
+		}
+	})
+
+	t.Run("GoingAway", func(t *testing.T) {
+		accept, _ := frame{kind: kindAccept}.MarshalBinary()
+		gone := &mockSess{closed: true, code: ErrorCodeGoingAway}
+		fresh := &mockSess{streamFactory: func() quic.Stream { return newReplyStream(accept) }}
+
+		var dials int
+		dm := newDialMux(nil, newMux())
+		dm.factory = func(context.Context, string, *tls.Config, *quic.Config) (quic.Session, error) {
+			dials++
+			if dials == 1 {
+				return gone, nil
+			}
+			return fresh, nil
+		}
+
+		u, _ := url.Parse("quic://127.0.0.1:9001/a")
+		if err := dm.LoadSession(netloc{u}, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if c, err := dm.Dial(request{path: "/a"}, 0); err != nil {
+			t.Fatal(err)
+		} else if c.(*conn).Session.(*refcntSession).Session != fresh {
+			t.Error("stream not opened on a fresh session")
+		}
+
+		t.Run("Twice", func(t *testing.T) {
+			dials = 0
+			fresh.closed, fresh.code = true, ErrorCodeGoingAway
+
+			if err := dm.LoadSession(netloc{u}, nil, nil); err != nil {
+				t.Fatal(err)
+			} else if _, err = dm.Dial(request{path: "/a"}, 0); errors.Cause(err) != ErrGoingAway {
+				t.Errorf("expected ErrGoingAway, got %v", err)
+			}
+		})
+	})
+
+	t.Run("Reverse", func(t *testing.T) {
+		const peer = "127.0.0.1:5555"
+
+		mx := newMux()
+		dm := newDialMux(nil, mx)
+		dm.reverse = true
+		dm.factory = func(context.Context, string, *tls.Config, *quic.Config) (quic.Session, error) {
+			t.Error("reverse dialer should not dial")
+			return nil, errors.New("unreachable")
+		}
+
+		u, _ := url.Parse("quic://" + peer + "/agent/metrics")
+		if err := dm.LoadSession(netloc{u}, nil, nil); err == nil {
+			t.Error("expected error for unknown peer")
+		}
+
+		dialed := newRefCntSession(&mockSess{}, peer, dm.mux)
+		mx.AddSession(peer, dialed.Incr())
+		if err := dm.LoadSession(netloc{u}, nil, nil); err == nil {
+			t.Error("dialed session mistaken for an inbound one")
+		}
+
+		inbound := newRefCntSession(&mockSess{}, peer, dm.mux)
+		inbound.inbound = true
+		mx.AddInbound(peer, inbound.Incr())
+
+		if err := dm.LoadSession(netloc{u}, nil, nil); err != nil {
+			t.Error(err)
+		} else if dm.sess != inbound {
+			t.Error("inbound session not used")
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		u, _ := url.Parse("quic://127.0.0.1:9001/a")
+
+		t.Run("Dial", func(t *testing.T) {
+			dm := newDialMux(nil, newMux())
+			dm.timeout = time.Millisecond * 10
+			dm.expires = time.Now().Add(dm.timeout)
+			dm.factory = func(c context.Context, _ string, _ *tls.Config, _ *quic.Config) (quic.Session, error) {
+				<-c.Done()
+				return nil, c.Err()
+			}
+
+			err := dm.LoadSession(netloc{u}, nil, nil)
+			if te, ok := errors.Cause(err).(*TimeoutError); !ok || !te.Is(ErrDialTimeout) {
+				t.Errorf("expected ErrDialTimeout, got %v", err)
+			}
+		})
+
+		t.Run("Handshake", func(t *testing.T) {
+			dm := newDialMux(nil, newMux())
+			dm.factory = func(context.Context, string, *tls.Config, *quic.Config) (quic.Session, error) {
+				return nil, timeoutError{}
+			}
+
+			err := dm.LoadSession(netloc{u}, nil, &quic.Config{HandshakeTimeout: time.Second})
+			if te, ok := errors.Cause(err).(*TimeoutError); !ok || !te.Is(ErrHandshakeTimeout) {
+				t.Errorf("expected ErrHandshakeTimeout, got %v", err)
+			} else if te.After != time.Second {
+				t.Errorf("expected timeout after 1s, got %s", te.After)
+			}
+		})
+
+		t.Run("Negotiation", func(t *testing.T) {
+			dm := newDialMux(nil, newMux())
+			dm.factory = func(context.Context, string, *tls.Config, *quic.Config) (quic.Session, error) {
+				return &mockSess{streamFactory: func() quic.Stream { return newStallStream() }}, nil
+			}
+
+			if err := dm.LoadSession(netloc{u}, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			// the dial's deadline expires before the negotiation's
+			dm.timeout = time.Millisecond * 10
+			dm.expires = time.Now().Add(dm.timeout)
+
+			_, err := dm.Dial(request{path: "/a"}, time.Minute)
+			if te, ok := errors.Cause(err).(*TimeoutError); !ok || !te.Is(ErrDialTimeout) {
+				t.Errorf("expected ErrDialTimeout, got %v", err)
+			}
+		})
+	})
+
+	t.Run("SharedSocket", func(t *testing.T) {
+		const local = "0.0.0.0:9001"
+
+		mx := newMux()
+		pc := &mockPacketConn{}
+		mx.network = mockNetwork(func(string) (net.PacketConn, error) { return pc, nil })
+
+		// the listener holds the socket open
+		mx.Lock()
+		held, _ := mx.LoadConn(local)
+		mx.Unlock()
+
+		c, closeSess := context.WithCancel(context.Background())
+		dm := newDialMux(nil, mx)
+		dm.local = local
+		dm.factory = func(context.Context, string, *tls.Config, *quic.Config) (quic.Session, error) {
+			t.Error("dialer should dial from the shared socket")
+			return nil, errors.New("unreachable")
+		}
+		dm.dialer = func(_ context.Context, conn net.PacketConn, raddr net.Addr, host string, _ *tls.Config, _ *quic.Config) (quic.Session, error) {
+			if conn != held {
+				t.Error("session not dialed from the shared socket")
+			} else if raddr.String() != "127.0.0.1:5555" || host != "127.0.0.1:5555" {
+				t.Errorf("unexpected remote address %s (%s)", raddr, host)
+			}
+			return &mockSess{contextFactory: func() context.Context { return c }}, nil
+		}
+
+		u, _ := url.Parse("quic://127.0.0.1:5555/a")
+		if err := dm.LoadSession(netloc{u}, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		closeSess()
+		time.Sleep(time.Millisecond * 10)
+
+		mx.Lock()
+		defer mx.Unlock()
+
+		if held.refcnt != 1 {
+			t.Errorf("expected the session to release the socket, got %d references", held.refcnt)
+		} else if _ = mx.ReleaseConn(held); !pc.closed {
+			t.Error("socket not closed")
+		}
+	})
+
+	t.Run("Pool", func(t *testing.T) {
+		accept, _ := frame{kind: kindAccept}.MarshalBinary()
+		u, _ := url.Parse("quic://127.0.0.1:9001/a")
+
+		newPooledDialMux := func(cfg poolCfg, sessions ...*mockSess) (*dialMux, *int) {
+			var dials int
+			dm := newDialMux(nil, newMux())
+			dm.pool = cfg
+			dm.factory = func(context.Context, string, *tls.Config, *quic.Config) (quic.Session, error) {
+				s := sessions[dials]
+				s.streamFactory = func() quic.Stream { return newReplyStream(accept) }
+				dials++
+				return s, nil
+			}
+			return dm, &dials
+		}
+
+		t.Run("Overflow", func(t *testing.T) {
+			full, spare := &mockSess{saturated: true}, &mockSess{}
+			dm, dials := newPooledDialMux(poolCfg{max: 2}, full, spare)
+
+			if err := dm.LoadSession(netloc{u}, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			c, err := dm.Dial(request{path: "/a"}, 0)
+			if err != nil {
+				t.Fatal(err)
+			} else if *dials != 2 {
+				t.Errorf("expected 2 sessions, dialed %d", *dials)
+			} else if c.(*conn).Session.(*refcntSession).Session != spare {
+				t.Error("stream not opened on the spare session")
+			}
+		})
+
+		t.Run("Full", func(t *testing.T) {
+			full := &mockSess{saturated: true}
+			dm, dials := newPooledDialMux(poolCfg{max: 1}, full)
+
+			if err := dm.LoadSession(netloc{u}, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			// with no room in the pool, we wait for the saturated session
+			if c, err := dm.Dial(request{path: "/a"}, 0); err != nil {
+				t.Fatal(err)
+			} else if *dials != 1 {
+				t.Errorf("expected 1 session, dialed %d", *dials)
+			} else if c.(*conn).Session.(*refcntSession).Session != full {
+				t.Error("stream not opened on the saturated session")
+			}
+		})
+
+		t.Run("FullTimeout", func(t *testing.T) {
+			full := &mockSess{saturated: true}
+			dm, _ := newPooledDialMux(poolCfg{max: 1}, full)
+			if err := dm.LoadSession(netloc{u}, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			release := make(chan struct{})
+			defer close(release)
+			full.streamFactory = func() quic.Stream {
+				<-release // no stream frees up before the dial expires
+				return newMockStream()
+			}
+			dm.timeout = time.Millisecond
+			dm.expires = time.Now().Add(dm.timeout)
+
+			_, err := dm.Dial(request{path: "/a"}, 0)
+			if te, ok := errors.Cause(err).(*TimeoutError); !ok || !te.Is(ErrDialTimeout) {
+				t.Errorf("expected ErrDialTimeout, got %v", err)
+			}
+		})
+
+		t.Run("Spread", func(t *testing.T) {
+			dm, dials := newPooledDialMux(poolCfg{max: 2, policy: PolicySpread}, &mockSess{}, &mockSess{})
+
+			var loaded []*refcntSession
+			for i := 0; i < 3; i++ {
+				if err := dm.LoadSession(netloc{u}, nil, nil); err != nil {
+					t.Fatal(err)
+				}
+				loaded = append(loaded, dm.sess)
+			}
+
+			if *dials != 2 {
+				t.Errorf("expected 2 sessions, dialed %d", *dials)
+			} else if loaded[0] == loaded[1] {
+				t.Error("paths not spread across sessions")
+			} else if loaded[2].load() != 2 || loaded[0].load()+loaded[1].load() != 3 {
+				t.Error("third path not sent to the least loaded session")
+			}
+		})
+	})
+
+	t.Run("Unlocked", func(t *testing.T) {
+		u, _ := url.Parse("quic://127.0.0.1:9001/a")
+		mx := newMux()
+
+		var dials int32
+		dialing, release := make(chan struct{}), make(chan struct{})
+		factory := func(context.Context, string, *tls.Config, *quic.Config) (quic.Session, error) {
+			if atomic.AddInt32(&dials, 1) == 1 {
+				close(dialing)
+			}
+			<-release
+			return &mockSess{}, nil
+		}
+
+		loaded := make(chan error, 2)
+		for i := 0; i < 2; i++ {
+			dm := newDialMux(nil, mx)
+			dm.factory = factory
+			go func() { loaded <- dm.LoadSession(netloc{u}, nil, nil) }()
+		}
+		<-dialing
+
+		// The handshake must not hold up the rest of the transport
+		locked := make(chan struct{})
+		go func() {
+			mx.Lock()
+			mx.Unlock()
+			close(locked)
+		}()
+
+		select {
+		case <-locked:
+		case <-time.After(time.Second):
+			t.Fatal("multiplexer locked while dialing")
+		}
+
+		close(release)
+		for i := 0; i < 2; i++ {
+			if err := <-loaded; err != nil {
+				t.Error(err)
+			}
+		}
+
+		if n := atomic.LoadInt32(&dials); n != 1 {
+			t.Errorf("expected the second dialer to wait for the first, dialed %d sessions", n)
+		} else if s, _ := mx.GetSession("127.0.0.1:9001"); s == nil || s.load() != 2 {
+			t.Error("dialed session not shared")
+		}
+	})
+
+	t.Run("Dial", func(t *testing.T) {
+		t.Run("Redirect", func(t *testing.T) {
+			frames := func(fs ...frame) (replies [][]byte) {
+				for _, f := range fs {
+					b, _ := f.MarshalBinary()
+					replies = append(replies, b)
+				}
+				return
+			}
+
+			redirect := frame{kind: kindRedirect}
+			redirect.add(fieldPath, []byte("/new/path"))
+
+			var streams []*replyStream
+			newDialMuxWithReplies := func(replies [][]byte) *dialMux {
+				streams = nil
+				dm := newDialMux(nil, newMux())
+				dm.sess = newRefCntSession(&mockSess{streamFactory: func() quic.Stream {
+					s := newReplyStream(replies[len(streams)%len(replies)])
+					streams = append(streams, s)
+					return s
+				}}, "", dm.mux).Incr()
+				return dm
+			}
+
+			t.Run("Follow", func(t *testing.T) {
+				dm := newDialMuxWithReplies(frames(redirect, frame{kind: kindAccept}))
+
+				if _, err := dm.Dial(request{path: "/old/path"}, 0); err != nil {
+					t.Fatal(err)
+				} else if len(streams) != 2 {
+					t.Fatalf("expected 2 streams, got %d", len(streams))
+				}
+
+				if req, err := newNegotiator(streams[1].bufCloser).ReadHeaders(); err != nil {
+					t.Error(err)
+				} else if req.path != "/new/path" {
+					t.Errorf("expected redirect to /new/path, got %s", req.path)
+				} else if !streams[0].closed {
+					t.Error("redirected stream not closed")
+				} else if dm.moved.Code != 0 {
+					t.Errorf("temporary redirect remembered: %v", &dm.moved)
+				}
+			})
+
+			t.Run("Permanent", func(t *testing.T) {
+				moved := frame{kind: kindRedirect}
+				moved.add(fieldStatus, []byte{0x01, 0x2d}) // 301
+				moved.add(fieldPath, []byte("/moved"))
+
+				dm := newDialMuxWithReplies(frames(moved, frame{kind: kindAccept}))
+				if _, err := dm.Dial(request{path: "/old/path"}, 0); err != nil {
+					t.Fatal(err)
+				} else if dm.moved.Code != StatusMovedPermanently || dm.moved.Path != "/moved" {
+					t.Errorf("permanent redirect not remembered: %v", &dm.moved)
+				}
+
+				// a permanent redirect issued after a temporary one only holds
+				// for the temporary location
+				dm = newDialMuxWithReplies(frames(redirect, moved, frame{kind: kindAccept}))
+				if _, err := dm.Dial(request{path: "/old/path"}, 0); err != nil {
+					t.Fatal(err)
+				} else if dm.moved.Code != 0 {
+					t.Errorf("redirect after a temporary one remembered: %v", &dm.moved)
+				}
+			})
+
+			t.Run("TooManyRedirects", func(t *testing.T) {
+				dm := newDialMuxWithReplies(frames(redirect))
+
+				if _, err := dm.Dial(request{path: "/old/path"}, 0); errors.Cause(err) != ErrTooManyRedirects {
+					t.Errorf("expected ErrTooManyRedirects, got %v", err)
+				} else if len(streams) != maxRedirects+1 {
+					t.Errorf("expected %d streams, got %d", maxRedirects+1, len(streams))
+				}
+			})
+		})
+
+		t.Run("Timeout", func(t *testing.T) {
+			stream := newStallStream()
+			dm := newDialMux(nil, newMux())
+			dm.sess = newRefCntSession(&mockSess{streamFactory: func() quic.Stream {
+				return stream
+			}}, "", dm.mux).Incr()
+
+			_, err := dm.Dial(request{path: "/some/path"}, time.Millisecond*10)
+			if ne, ok := errors.Cause(err).(*NegotiationError); !ok {
+				t.Errorf("expected *NegotiationError, got %v", err)
+			} else if ne.Code != StatusTimeout {
+				t.Errorf("expected status %d, got %d", StatusTimeout, ne.Code)
+			} else if !stream.closed {
+				t.Error("stream not closed")
+			}
+		})
+	})
+}
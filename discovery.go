@@ -0,0 +1,107 @@
+package quic
+
+import (
+	"encoding/binary"
+	"net/url"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// DiscoveryPath is reserved for route discovery.  Unless a listener disables it
+// with OptionDiscovery, streams negotiated on this path are answered by the
+// transport itself with the routes it serves.
+const DiscoveryPath = "/.well-known/mangos"
+
+// RouteInfo describes a route served by a remote listener
+type RouteInfo struct {
+	Path         string // pattern under which the route was registered
+	Protocol     uint16 // SP protocol of the listening socket; 0 if unknown
+	PeerProtocol uint16 // SP protocol the listening socket talks to; 0 if unknown
+}
+
+func (ri RouteInfo) encode(f *frame) {
+	b := make([]byte, 4, 4+len(ri.Path))
+	binary.BigEndian.PutUint16(b, ri.Protocol)
+	binary.BigEndian.PutUint16(b[2:], ri.PeerProtocol)
+	f.add(fieldRoute, append(b, ri.Path...))
+}
+
+func decodeRoutes(f frame) ([]RouteInfo, error) {
+	vals := f.all(fieldRoute)
+	routes := make([]RouteInfo, 0, len(vals))
+	for _, b := range vals {
+		if len(b) < 4 {
+			return nil, errors.New("truncated route")
+		}
+
+		routes = append(routes, RouteInfo{
+			Protocol:     binary.BigEndian.Uint16(b),
+			PeerProtocol: binary.BigEndian.Uint16(b[2:]),
+			Path:         string(b[4:]),
+		})
+	}
+	return routes, nil
+}
+
+// List returns a description of every registered route, sorted by path
+func (r *router) List(netloc string) (routes []RouteInfo) {
+	r.RLock()
+	defer r.RUnlock()
+
+	r.routes.Walk(func(_ string, v interface{}) bool {
+		for _, rt := range v.([]*route) {
+			if !rt.servedOn(netloc) {
+				continue
+			}
+
+			ri := RouteInfo{Path: rt.pat.raw}
+			if rt.proto != nil {
+				ri.Protocol, ri.PeerProtocol = rt.proto.number, rt.proto.peer
+			}
+			routes = append(routes, ri)
+		}
+		return false
+	})
+
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Path < routes[j].Path })
+	return
+}
+
+// Discover lists the routes served at addr, e.g. "quic://127.0.0.1:9001".  It
+// reuses the transport's session to addr if there is one, and dials it
+// otherwise.
+func (t *Transport) Discover(addr string, opt map[string]interface{}) ([]RouteInfo, error) {
+	u, err := url.ParseRequestURI(addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "url parse")
+	}
+
+	o := newOpt()
+	for name, v := range opt {
+		if err = o.set(name, v); err != nil {
+			return nil, errors.Wrapf(err, "set %s", name)
+		}
+	}
+
+	dm := newDialMux(nil, t.mux)
+	tc, qc := getQUICCfg(o)
+	if err = dm.LoadSession(netloc{u}, tc, qc); err != nil {
+		return nil, errors.Wrap(err, "dial quic")
+	}
+
+	c, err := dm.Dial(request{path: DiscoveryPath}, getNegotiationTimeout(o))
+	if err != nil {
+		return nil, errors.Wrap(err, "dial path")
+	}
+	defer c.Close()
+
+	f, err := readFrame(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "read routes")
+	} else if f.kind != kindRoutes {
+		return nil, errors.Errorf("unexpected frame kind %d", f.kind)
+	}
+
+	return decodeRoutes(f)
+}
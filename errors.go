@@ -0,0 +1,131 @@
+package quic
+
+import (
+	"fmt"
+	"time"
+
+	quic "github.com/lucas-clemente/quic-go"
+	"github.com/pkg/errors"
+)
+
+// Status codes sent by a listener when it aborts path negotiation.  They
+// deliberately mirror their HTTP counterparts.
+const (
+	StatusMovedPermanently  = 301
+	StatusTemporaryRedirect = 307
+
+	StatusBadRequest       = 400
+	StatusForbidden        = 403
+	StatusNotFound         = 404
+	StatusProtocolMismatch = 406 // the dialer's SP protocol cannot talk to the listener's
+	StatusTimeout          = 408 // the negotiation did not complete in time
+	StatusBusy             = 429 // the route's accept backlog is full
+	StatusUnavailable      = 503
+)
+
+// NegotiationError is returned when a listener refuses to route a stream to the
+// requested path.  Dialers can inspect Code to decide whether to retry, e.g.
+// backing off on StatusNotFound and failing fast on StatusForbidden.
+//
+// Errors returned by this package are wrapped with github.com/pkg/errors, so
+// use errors.Cause to recover the *NegotiationError, or errors.Is to compare it
+// against one of the sentinel values below.
+type NegotiationError struct {
+	Code    int
+	Message string
+}
+
+// Sentinel negotiation errors.  A *NegotiationError matches a sentinel when
+// their codes are equal, regardless of the message.
+var (
+	ErrMalformedHeader  = &NegotiationError{Code: StatusBadRequest, Message: "malformed header"}
+	ErrForbidden        = &NegotiationError{Code: StatusForbidden, Message: "forbidden"}
+	ErrRouteNotFound    = &NegotiationError{Code: StatusNotFound, Message: "route not found"}
+	ErrProtocolMismatch = &NegotiationError{Code: StatusProtocolMismatch, Message: "protocol mismatch"}
+	ErrTimeout          = &NegotiationError{Code: StatusTimeout, Message: "negotiation timed out"}
+	ErrBusy             = &NegotiationError{Code: StatusBusy, Message: "busy"}
+	ErrUnavailable      = &NegotiationError{Code: StatusUnavailable, Message: "unavailable"}
+)
+
+func (e *NegotiationError) Error() string {
+	return fmt.Sprintf("negotiation failed with status %d: %s", e.Code, e.Message)
+}
+
+// Is reports whether target is a *NegotiationError with the same code.
+func (e *NegotiationError) Is(target error) bool {
+	t, ok := target.(*NegotiationError)
+	return ok && t.Code == e.Code
+}
+
+// Redirect instructs a dialer to negotiate its stream elsewhere.  Returning one
+// from a FallbackFunc redirects the stream; dialers follow redirects
+// transparently, up to a bounded number of hops.  A dialer remembers where
+// StatusMovedPermanently sent it, and dials there directly from then on.
+type Redirect struct {
+	Code   int    // StatusTemporaryRedirect (default) or StatusMovedPermanently
+	Netloc string // host:port to dial instead; empty to stay on the same session
+	Path   string // path to request instead; empty to keep the same path
+}
+
+func (r *Redirect) code() int {
+	if r.Code == 0 {
+		return StatusTemporaryRedirect
+	}
+	return r.Code
+}
+
+func (r *Redirect) Error() string {
+	return fmt.Sprintf("redirected with status %d to %s%s", r.code(), r.Netloc, r.Path)
+}
+
+// ErrTooManyRedirects is returned by a dialer that was redirected more than
+// maxRedirects times.
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+// asNegotiationError returns the *NegotiationError that caused err, or wraps
+// err in one with the given code.
+func asNegotiationError(err error, code int) *NegotiationError {
+	if ne, ok := errors.Cause(err).(*NegotiationError); ok {
+		return ne
+	}
+	return &NegotiationError{Code: code, Message: err.Error()}
+}
+
+// TimeoutError is returned when an operation bounded by OptionAcceptTimeout,
+// OptionDialTimeout or OptionHandshakeTimeout does not complete in time.  It
+// implements net.Error, and matches the sentinel below for its operation.
+type TimeoutError struct {
+	Op    string        // "accept", "dial" or "handshake"
+	After time.Duration // the timeout that expired
+}
+
+// Sentinel timeout errors.  A *TimeoutError matches a sentinel when their
+// operations are equal, regardless of the duration.
+var (
+	ErrAcceptTimeout    = &TimeoutError{Op: "accept"}
+	ErrDialTimeout      = &TimeoutError{Op: "dial"}
+	ErrHandshakeTimeout = &TimeoutError{Op: "handshake"}
+)
+
+func (e *TimeoutError) Error() string { return fmt.Sprintf("%s timed out after %s", e.Op, e.After) }
+
+// Timeout always returns true, as per net.Error
+func (e *TimeoutError) Timeout() bool { return true }
+
+// Temporary always returns true, as per net.Error
+func (e *TimeoutError) Temporary() bool { return true }
+
+// Is reports whether target is a *TimeoutError for the same operation.
+func (e *TimeoutError) Is(target error) bool {
+	t, ok := target.(*TimeoutError)
+	return ok && t.Op == e.Op
+}
+
+// ErrorCodeGoingAway is the application error code with which a listener closes
+// its sessions when it shuts down, and a transport when it is closed.  Peers
+// should reconnect rather than treat it as a failure.
+const ErrorCodeGoingAway quic.ErrorCode = 0x4741
+
+// ErrGoingAway is returned by a dialer whose session was closed by the listener
+// with ErrorCodeGoingAway.
+var ErrGoingAway = errors.New("server going away")
@@ -0,0 +1,49 @@
+package quic
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestTimeoutError(t *testing.T) {
+	var err error = &TimeoutError{Op: "dial", After: time.Second}
+
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() || !isTimeout(errors.Wrap(err, "dial")) {
+		t.Error("expected a net.Error reporting a timeout")
+	}
+
+	te := err.(*TimeoutError)
+	if !te.Is(ErrDialTimeout) {
+		t.Error("expected error to match ErrDialTimeout")
+	} else if te.Is(ErrAcceptTimeout) || te.Is(ErrTimeout) {
+		t.Error("error matches the wrong sentinel")
+	}
+}
+
+func TestNegotiationError(t *testing.T) {
+	err := errors.Wrap(&NegotiationError{Code: StatusNotFound, Message: "/some/path"}, "dial path")
+
+	t.Run("Cause", func(t *testing.T) {
+		if ne, ok := errors.Cause(err).(*NegotiationError); !ok {
+			t.Errorf("expected *NegotiationError, got %T", errors.Cause(err))
+		} else if ne.Code != StatusNotFound {
+			t.Errorf("expected code %d, got %d", StatusNotFound, ne.Code)
+		}
+	})
+
+	t.Run("Is", func(t *testing.T) {
+		// through the wrap chain, as callers do
+		if !errors.Is(errors.Wrap(err, "dial"), ErrRouteNotFound) {
+			t.Error("expected error to match ErrRouteNotFound")
+		}
+
+		for _, sentinel := range []error{ErrMalformedHeader, ErrForbidden, ErrUnavailable} {
+			if errors.Is(err, sentinel) {
+				t.Errorf("error should not match %s", sentinel)
+			}
+		}
+	})
+}
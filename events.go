@@ -0,0 +1,142 @@
+package quic
+
+import (
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// SessionEventKind distinguishes the events in the lifecycle of a session
+type SessionEventKind int
+
+const (
+	// SessionOpened is emitted when a session is dialed or accepted
+	SessionOpened SessionEventKind = iota
+	// SessionClosed is emitted once a session is closed, whichever side
+	// closed it
+	SessionClosed
+	// SessionMigrated is emitted when the remote address of a session changes,
+	// e.g. because the peer's NAT binding was renewed
+	SessionMigrated
+)
+
+// Reasons given for closed sessions, besides ErrGoingAway
+var (
+	// ErrSessionUnused is given for sessions closed because no stream or
+	// listener uses them any more
+	ErrSessionUnused = errors.New("session unused")
+	// ErrSessionClosed is given for sessions closed for no reason known to
+	// quic-go.  Sessions closed by the peer, or that timed out, give the
+	// error quic-go closed them with instead.
+	ErrSessionClosed = errors.New("session closed")
+	// ErrSessionIdle is given for inbound sessions closed by the reaper, see
+	// Transport.SetPipeIdleTimeout
+	ErrSessionIdle = errors.New("session idle")
+)
+
+// SessionEvent describes a change in the lifecycle of a session owned by a
+// transport
+type SessionEvent struct {
+	Kind       SessionEventKind
+	Inbound    bool     // the session was accepted, rather than dialed
+	LocalAddr  net.Addr // local address of the session
+	RemoteAddr net.Addr // remote address, i.e. the new one for SessionMigrated
+	Paths      []string // paths open on the session, sorted
+	Err        error    // reason the session was closed, for SessionClosed
+}
+
+// Subscribe calls fn with the events of every session owned by the transport,
+// until the returned function is called.  Events are delivered in order, from
+// a goroutine of their own, so fn may call into the transport.
+func (t *Transport) Subscribe(fn func(SessionEvent)) (cancel func()) {
+	return t.mux.events.subscribe(fn)
+}
+
+// observers dispatches session events to their subscribers
+type observers struct {
+	sync.Mutex
+	subs    map[int]func(SessionEvent)
+	next    int
+	queue   []SessionEvent
+	running bool // a goroutine is draining the queue
+}
+
+func (o *observers) subscribe(fn func(SessionEvent)) func() {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.subs == nil {
+		o.subs = make(map[int]func(SessionEvent))
+	}
+
+	id := o.next
+	o.subs[id], o.next = fn, o.next+1
+
+	return func() {
+		o.Lock()
+		delete(o.subs, id)
+		o.Unlock()
+	}
+}
+
+func (o *observers) emit(ev SessionEvent) {
+	o.Lock()
+	defer o.Unlock()
+
+	if len(o.subs) == 0 {
+		return
+	}
+
+	o.queue = append(o.queue, ev)
+	if !o.running {
+		o.running = true
+		go o.dispatch()
+	}
+}
+
+func (o *observers) dispatch() {
+	for {
+		o.Lock()
+		if len(o.queue) == 0 {
+			o.running = false
+			o.Unlock()
+			return
+		}
+
+		ev := o.queue[0]
+		o.queue = o.queue[1:]
+
+		subs := make([]func(SessionEvent), 0, len(o.subs))
+		for _, fn := range o.subs {
+			subs = append(subs, fn)
+		}
+		o.Unlock()
+
+		for _, fn := range subs {
+			fn(ev)
+		}
+	}
+}
+
+// event returns an event of the given kind for the session
+func (r *refcntSession) event(kind SessionEventKind, err error) SessionEvent {
+	r.pathsMu.Lock()
+	defer r.pathsMu.Unlock()
+
+	paths := make([]string, 0, len(r.paths))
+	for p := range r.paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	return SessionEvent{
+		Kind:       kind,
+		Inbound:    r.inbound,
+		LocalAddr:  r.LocalAddr(),
+		RemoteAddr: r.RemoteAddr(),
+		Paths:      paths,
+		Err:        err,
+	}
+}
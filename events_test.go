@@ -0,0 +1,116 @@
+package quic
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	quic "github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/qerr"
+)
+
+// recordEvents subscribes to the events of m, and returns the channel they are
+// delivered on
+func recordEvents(m *multiplexer) (<-chan SessionEvent, func()) {
+	ch := make(chan SessionEvent, 16)
+	return ch, m.events.subscribe(func(ev SessionEvent) { ch <- ev })
+}
+
+func nextEvent(t *testing.T, ch <-chan SessionEvent) SessionEvent {
+	select {
+	case ev := <-ch:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("no event emitted")
+	}
+	return SessionEvent{}
+}
+
+func TestSessionEvents(t *testing.T) {
+	t.Run("Lifecycle", func(t *testing.T) {
+		m := newMux()
+		ch, cancel := recordEvents(m)
+		defer cancel()
+
+		ms := &mockSess{addr: "127.0.0.1:9001"}
+		sess := newRefCntSession(ms, "k", m).Incr()
+		sess.open()
+
+		if ev := nextEvent(t, ch); ev.Kind != SessionOpened || ev.RemoteAddr.String() != "127.0.0.1:9001" {
+			t.Errorf("unexpected event %+v", ev)
+		}
+
+		sess.track("/a", newMockStream())
+		sess.track("/b", newMockStream())
+		sess.track("/a", newMockStream())
+
+		ms.addr = "127.0.0.1:9002"
+		sess.track("/c", newMockStream())
+
+		ev := nextEvent(t, ch)
+		if ev.Kind != SessionMigrated || ev.RemoteAddr.String() != "127.0.0.1:9002" {
+			t.Errorf("unexpected event %+v", ev)
+		}
+
+		_ = sess.DecrAndClose()
+		_ = sess.goAway() // already closed, so no second event
+
+		ev = nextEvent(t, ch)
+		if ev.Kind != SessionClosed || ev.Err != ErrSessionUnused {
+			t.Errorf("unexpected event %+v", ev)
+		} else if want := []string{"/a", "/b", "/c"}; !reflect.DeepEqual(ev.Paths, want) {
+			t.Errorf("expected paths %v, got %v", want, ev.Paths)
+		}
+
+		select {
+		case ev := <-ch:
+			t.Errorf("unexpected event %+v", ev)
+		case <-time.After(10 * time.Millisecond):
+		}
+	})
+
+	t.Run("ClosedByPeer", func(t *testing.T) {
+		m := newMux()
+		ch, cancel := recordEvents(m)
+		defer cancel()
+
+		for _, tc := range []struct {
+			name string
+			code quic.ErrorCode
+			is   func(error) bool
+		}{
+			{"Error", 0x42, func(err error) bool {
+				qe, ok := err.(*qerr.QuicError)
+				return ok && qe.ErrorCode == 0x42
+			}},
+			{"GoingAway", ErrorCodeGoingAway, func(err error) bool { return err == ErrGoingAway }},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				c, closeSess := context.WithCancel(context.Background())
+				ms := &mockSess{contextFactory: func() context.Context { return c }}
+				newRefCntSession(ms, "k", m).open()
+				nextEvent(t, ch)
+
+				_ = ms.CloseWithError(tc.code, nil)
+				closeSess()
+				if ev := nextEvent(t, ch); ev.Kind != SessionClosed || !tc.is(ev.Err) {
+					t.Errorf("unexpected event %+v", ev)
+				}
+			})
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		m := newMux()
+		ch, cancel := recordEvents(m)
+		cancel()
+
+		newRefCntSession(&mockSess{}, "k", m).open()
+		select {
+		case ev := <-ch:
+			t.Errorf("event delivered after cancel: %+v", ev)
+		case <-time.After(10 * time.Millisecond):
+		}
+	})
+}
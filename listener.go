@@ -3,7 +3,10 @@ package quic
 import (
 	"crypto/tls"
 	"net"
+	"net/url"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/SentimensRG/ctx"
 	quic "github.com/lucas-clemente/quic-go"
@@ -21,17 +24,26 @@ type refcntListener struct {
 	ctx.Doner
 	gc     func()
 	refcnt int32
+	netloc netlocator
 	quic.Listener
+
+	sessMu   sync.Mutex
+	sessions map[*refcntSession]struct{} // accepted sessions, nil once shut down
 }
 
 func newRefCntListener(n netlocator, l quic.Listener, d listenDeleter) *refcntListener {
+	var once sync.Once // the multiplexer may tear us down before our last Decr
 	cq := make(chan struct{})
 	return &refcntListener{
 		Listener: l,
+		netloc:   n,
+		sessions: make(map[*refcntSession]struct{}),
 		Doner:    ctx.C(cq),
 		gc: func() {
-			close(cq)
-			d.DelListener(n)
+			once.Do(func() {
+				close(cq)
+				d.DelListener(n)
+			})
 		},
 	}
 }
@@ -43,103 +55,569 @@ func (r *refcntListener) Incr() *refcntListener {
 
 func (r *refcntListener) DecrAndClose() (err error) {
 	if i := atomic.AddInt32(&r.refcnt, -1); i == 0 {
-		err = r.Close()
-		r.gc()
+		err = r.shutdown()
 	} else if i < 0 {
 		panic("already closed")
 	}
 	return
 }
 
+// hold keeps track of sess until it is closed, so that shutdown can tell its
+// peer that we're going away
+func (r *refcntListener) hold(sess *refcntSession) {
+	r.sessMu.Lock()
+	if r.sessions == nil {
+		r.sessMu.Unlock()
+		_ = sess.goAway() // accepted as we were shutting down
+		return
+	}
+	r.sessions[sess] = struct{}{}
+	r.sessMu.Unlock()
+
+	ctx.Defer(sess.Context(), func() {
+		r.sessMu.Lock()
+		delete(r.sessions, sess)
+		r.sessMu.Unlock()
+	})
+}
+
+// shutdown goes away from the sessions accepted by the listener, and then
+// closes it.  Closing the listener first would close them without a word to
+// their peers.
+func (r *refcntListener) shutdown() error {
+	r.sessMu.Lock()
+	ss := r.sessions
+	r.sessions = nil
+	r.sessMu.Unlock()
+
+	for sess := range ss {
+		_ = sess.goAway()
+	}
+
+	defer r.gc()
+	return r.Close()
+}
+
 // listenMux implements muxListener
 type listenMux struct {
 	mux     *multiplexer
 	factory lstnFactory
 	l       *refcntListener
+	extra   []*refcntListener // listeners on further addresses, sharing l's routes
+	rev     *reverseSession   // set instead of l when serving over a dialed session
 }
 
 func newListenMux(m *multiplexer, fn lstnFactory) *listenMux {
 	return &listenMux{mux: m, factory: fn}
 }
 
-func (lm *listenMux) LoadListener(n netlocator, tc *tls.Config, qc *quic.Config) error {
+func (lm *listenMux) LoadListener(n netlocator, tc *tls.Config, qc *quic.Config) (err error) {
+	lm.l, err = lm.loadListener(n, tc, qc)
+	return
+}
+
+// LoadExtraListener loads a listener for n on top of the one loaded by
+// LoadListener.  Its streams are routed to the same paths.
+func (lm *listenMux) LoadExtraListener(n netlocator, tc *tls.Config, qc *quic.Config) error {
+	l, err := lm.loadListener(n, tc, qc)
+	if err != nil {
+		return err
+	}
+
+	lm.extra = append(lm.extra, l)
+	return nil
+}
+
+func (lm *listenMux) loadListener(n netlocator, tc *tls.Config, qc *quic.Config) (*refcntListener, error) {
 	lm.mux.Lock()
 	defer lm.mux.Unlock()
 
-	var ok bool
-	if lm.l, ok = lm.mux.GetListener(n); !ok {
+	l, ok := lm.mux.GetListener(n)
+	if !ok {
 
 		// We don't have a listener for this netloc yet, so create it.
 		ql, err := lm.factory(n.Netloc(), tc, qc)
 		if err != nil {
-			return err
+			return nil, err
+		}
+
+		// Listeners on an ephemeral port are known by the port they got, so
+		// that later listeners on that port share them.
+		if host := boundHost(n.Netloc(), ql.Addr()); host != n.Netloc() {
+			n = netloc{&url.URL{Host: host}}
 		}
 
 		// Init refcnt to track the Listener's usage and clean up when we're done
-		lm.l = newRefCntListener(n, ql, lm.mux)
-		lm.mux.AddListener(n, lm.l)
+		l = newRefCntListener(n, ql, lm.mux)
+		lm.mux.AddListener(n, l)
+
+		// A single loop accepts the listener's sessions on behalf of every
+		// path served on its netloc.
+		go lm.acceptLoop(l)
+	}
+
+	return l.Incr(), nil
+}
+
+// listenShared returns a lstnFactory that listens on the transport's shared
+// socket bound to each address, rather than on a socket of its own, so that
+// dialers may dial from the same port.  The factory is called with the
+// multiplexer's lock held.
+func (lm *listenMux) listenShared(listen func(net.PacketConn, *tls.Config, *quic.Config) (quic.Listener, error)) lstnFactory {
+	return func(addr string, tc *tls.Config, qc *quic.Config) (quic.Listener, error) {
+		c, err := lm.mux.LoadConn(addr)
+		if err != nil {
+			return nil, errors.Wrap(err, "shared socket")
+		}
+
+		ql, err := listen(c, tc, qc)
+		if err != nil {
+			_ = lm.mux.ReleaseConn(c)
+			return nil, err
+		}
+		return &sharedListener{Listener: ql, mux: lm.mux, conn: c}, nil
+	}
+}
+
+// sharedListener is a quic.Listener on a shared socket, which it releases when
+// closed
+type sharedListener struct {
+	quic.Listener
+	mux  *multiplexer
+	conn *sharedConn
+}
+
+func (l *sharedListener) Close() error {
+	err := l.Listener.Close()
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if e := l.mux.ReleaseConn(l.conn); err == nil {
+		err = e
+	}
+	return err
+}
+
+// listenFamily is the lstnFactory of listeners whose hosts span IPv4 and IPv6.
+// It binds each address on the network of its family, since over "udp" an IPv6
+// wildcard such as [::] takes the IPv4 port as well.
+func listenFamily(addr string, tc *tls.Config, qc *quic.Config) (quic.Listener, error) {
+	pc, err := net.ListenPacket(udpFamily(addr), addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ql, err := quic.Listen(pc, tc, qc)
+	if err != nil {
+		_ = pc.Close()
+		return nil, err
+	}
+	return &connListener{Listener: ql, conn: pc}, nil
+}
+
+// connListener is a quic.Listener that closes its socket along with itself, as
+// those returned by quic.ListenAddr do
+type connListener struct {
+	quic.Listener
+	conn net.PacketConn
+}
+
+func (l *connListener) Close() error {
+	err := l.Listener.Close()
+	if e := l.conn.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// LoadSession serves streams opened by the peer at n over the session dialed to
+// it by dm, rather than over a listener of our own.  Peers behind a NAT can thus
+// serve paths to the listener they dialed.  The session is dialed again whenever
+// the peer drops it, until the listener is closed.
+func (lm *listenMux) LoadSession(dm *dialMux, n netlocator, tc *tls.Config, qc *quic.Config) error {
+	if err := dm.LoadSession(n, tc, qc); err != nil {
+		return err
 	}
 
-	lm.l.Incr()
+	lm.rev = &reverseSession{sess: dm.sess, done: make(chan struct{})}
+	lm.rev.min, lm.rev.max = reconnectTimes(dm.sock)
+	if dm.sess.serve() {
+		go lm.mux.Serve(n, dm.sess)
+	}
+
+	// The transport stops reverse listeners when it is closed
+	lm.mux.Lock()
+	lm.mux.AddReverse(lm.rev)
+	lm.mux.Unlock()
+
+	go lm.redial(dm, n, dm.sess)
 	return nil
 }
 
-func (lm listenMux) Accept(path string) (conn net.Conn, err error) {
-	chConn := make(chan net.Conn)
+// redial waits for sess to be closed, and dials it again, backing off as mangos
+// dialers do, until the listener is closed
+func (lm *listenMux) redial(dm *dialMux, n netlocator, sess *refcntSession) {
+	for sess != nil {
+		select {
+		case <-sess.Context().Done():
+		case <-lm.rev.done:
+			return
+		}
 
-	if err = lm.mux.RegisterPath(path, chConn); err != nil {
-		err = errors.Wrapf(err, "register path %s", path)
-		return
+		// Drop the dead session, so that it is not handed back to us
+		if !lm.rev.drop(sess) {
+			return
+		}
+		sess = lm.redialOnce(dm, n)
 	}
+}
 
-	// Start the listen loop, which will produce sessions, accept their
-	// streams, and route them to the appropriate endpoint.
-	go ctx.FTick(lm.l, func() {
-		if sess, err := lm.l.Accept(); err == nil {
-			lm.mux.Lock()
-			defer lm.mux.Unlock()
+// redialOnce dials the reverse session until it succeeds, and returns it, or
+// nil if the listener was closed first
+func (lm *listenMux) redialOnce(dm *dialMux, n netlocator) *refcntSession {
+	for delay := lm.rev.min; ; {
+		select {
+		case <-time.After(delay):
+		case <-lm.rev.done:
+			return nil
+		}
 
-			sess := newRefCntSession(sess, lm.mux)
-			lm.mux.AddSession(sess.RemoteAddr(), sess.Incr())
+		if sess, err := dm.loadSession(n); err == nil {
+			if sess.Context().Err() == nil && lm.rev.replace(sess) {
+				if sess.serve() {
+					go lm.mux.Serve(n, sess)
+				}
+				return sess
+			}
+			_ = sess.DecrAndClose()
+		}
 
-			go lm.mux.Serve(sess)
+		if lm.rev.max > 0 {
+			if delay *= 2; delay > lm.rev.max {
+				delay = lm.rev.max
+			}
 		}
-	})
+	}
+}
 
-	return <-chConn, nil
+// reverseSession is the session a reverse listener serves over, which is
+// replaced whenever the peer drops it
+type reverseSession struct {
+	sync.Mutex
+	sess     *refcntSession // nil while redialing
+	done     chan struct{}  // closed when the listener is released
+	min, max time.Duration  // redial backoff, see reconnectTimes
+}
+
+func (rs *reverseSession) Done() <-chan struct{} { return rs.done }
+
+func (rs *reverseSession) session() *refcntSession {
+	rs.Lock()
+	defer rs.Unlock()
+	return rs.sess
+}
+
+// drop releases sess, unless the listener was released first.  It reports
+// whether the listener is still open.
+func (rs *reverseSession) drop(sess *refcntSession) bool {
+	rs.Lock()
+	defer rs.Unlock()
+
+	select {
+	case <-rs.done:
+		return false
+	default:
+	}
+
+	rs.sess = nil
+	_ = sess.DecrAndClose()
+	return true
+}
+
+// replace stores the redialed sess in place of the dropped one, unless the
+// listener was released in the meantime
+func (rs *reverseSession) replace(sess *refcntSession) bool {
+	rs.Lock()
+	defer rs.Unlock()
+
+	select {
+	case <-rs.done:
+		return false
+	default:
+	}
+
+	rs.sess = sess
+	return true
+}
+
+// stop keeps the reverse session from being redialed, and unblocks pending
+// calls to Accept.  It may be called more than once.
+func (rs *reverseSession) stop() {
+	rs.Lock()
+	defer rs.Unlock()
+	rs.stopLocked()
+}
+
+func (rs *reverseSession) stopLocked() {
+	select {
+	case <-rs.done:
+	default:
+		close(rs.done)
+	}
+}
+
+// release stops the reverse session, and drops our reference to it.  It may be
+// called more than once.
+func (rs *reverseSession) release() (err error) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	rs.stopLocked()
+	if rs.sess != nil {
+		err = rs.sess.DecrAndClose()
+		rs.sess = nil
+	}
+	return
+}
+
+// acceptLoop accepts the sessions of l, and serves the streams opened on them
+// until l is closed
+func (lm listenMux) acceptLoop(l *refcntListener) {
+	for {
+		qs, err := l.Accept()
+		if err != nil {
+			return // the listener was closed
+		}
+
+		// Inbound sessions are stored under their remote address, so that
+		// reverse dialers can open streams back to the peer.
+		sess := newRefCntSession(qs, qs.RemoteAddr().String(), lm.mux)
+		sess.inbound = true
+		lm.mux.Lock()
+		lm.mux.AddInbound(sess.key, sess.Incr())
+		lm.mux.Unlock()
+		sess.open()
+
+		sess.serve()
+		go func() {
+			lm.mux.Serve(l.netloc, sess)
+			_ = sess.DecrAndClose()
+		}()
+
+		// Tell the peer we're going away, rather than let it time out, once
+		// the listener is shut down.
+		l.hold(sess)
+	}
+}
+
+// Register routes the streams negotiated on path to rt
+func (lm listenMux) Register(path string, rt *route) error {
+	return errors.Wrapf(lm.mux.RegisterPath(path, rt), "register path %s", path)
+}
+
+// Accept returns the next stream routed to rt.  It may be called concurrently.
+func (lm listenMux) Accept(rt *route) (net.Conn, error) {
+	var done ctx.Doner = lm.l
+	if lm.rev != nil {
+		done = lm.rev
+	}
+
+	var expired <-chan time.Time
+	if rt.timeout > 0 {
+		t := time.NewTimer(rt.timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+
+	// Streams whose negotiation expired while in the backlog fail to accept,
+	// in which case we move on to the next one.
+	for {
+		select {
+		case p := <-rt.ch:
+			if conn, err := p.accept(); err == nil {
+				rt.track(conn)
+				return conn, nil
+			}
+		case <-rt.done:
+			return nil, mangos.ErrClosed
+		case <-done.Done():
+			return nil, mangos.ErrClosed
+		case <-expired:
+			return nil, &TimeoutError{Op: "accept", After: rt.timeout}
+		}
+	}
 }
 
 func (lm listenMux) Close(path string) error {
 	lm.mux.UnregisterPath(path)
-	return lm.l.DecrAndClose()
+	return lm.release()
+}
+
+// release drops our references to the listeners or session we serve over
+func (lm listenMux) release() (err error) {
+	if lm.rev != nil {
+		lm.mux.Lock()
+		lm.mux.DelReverse(lm.rev)
+		lm.mux.Unlock()
+		return lm.rev.release()
+	}
+
+	for _, l := range lm.extra {
+		if e := l.DecrAndClose(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if lm.l != nil {
+		if e := lm.l.DecrAndClose(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
 }
 
 type listener struct {
 	netloc
+	extra []netloc // further addresses to listen on, from the URL's hosts
 	*listenMux
-	opt  *options
-	sock mangos.Socket
+	rt       *route
+	opt      *options
+	sock     mangos.Socket
+	fallback bool // we registered the fallback for our netloc
+	hidden   bool // we disabled route discovery on our netloc
 }
 
 func (l *listener) Listen() error {
 	tc, qc := getQUICCfg(l.opt)
-	return errors.Wrap(l.LoadListener(l.netloc, tc, qc), "listen quic")
+	if getSharedSocket(l.opt) {
+		if spansFamilies(l.netlocs()) {
+			return errors.New("listen quic: shared sockets cannot span IPv4 and IPv6 hosts")
+		}
+		l.factory = l.listenShared(quic.Listen)
+	}
+
+	var err error
+	if getReverse(l.opt) {
+		if len(l.extra) > 0 {
+			return errors.New("listen quic: reverse listeners take a single address")
+		}
+		err = l.LoadSession(newDialMux(l.sock, l.mux), l.netloc, tc, qc)
+	} else {
+		err = l.LoadListener(l.netloc, tc, qc)
+		for i := 0; err == nil && i < len(l.extra); i++ {
+			if err = l.LoadExtraListener(l.extra[i], tc, qc); err != nil {
+				_ = l.release()
+			}
+		}
+	}
+	if err != nil {
+		return errors.Wrap(err, "listen quic")
+	}
+
+	// Report the ports we were bound to, in place of any ephemeral ones
+	if l.rev == nil {
+		l.Host = l.l.netloc.Netloc()
+		for i, rl := range l.listenMux.extra {
+			l.extra[i].Host = rl.netloc.Netloc()
+		}
+	}
+
+	backlog, policy := getBacklog(l.opt)
+	l.rt = &route{
+		ch:     make(chan pendingConn, backlog),
+		done:   make(chan struct{}),
+		policy: policy,
+		proto:  sockProto(l.sock),
+		codecs: getCompression(l.opt),
+
+		timeout:     getAcceptTimeout(l.opt),
+		negotiation: getNegotiationTimeout(l.opt),
+	}
+	for _, n := range l.netlocs() {
+		l.rt.netlocs = append(l.rt.netlocs, n.Netloc())
+	}
+
+	if err = l.Register(l.Path, l.rt); err != nil {
+		_ = l.release()
+		return errors.Wrap(err, "listen quic")
+	}
+
+	if fn := getFallback(l.opt); fn != nil {
+		for i, n := range l.netlocs() {
+			if err := l.mux.SetFallback(n, fn); err != nil {
+				for _, set := range l.netlocs()[:i] {
+					l.mux.DelFallback(set)
+				}
+				_ = l.listenMux.Close(l.Path)
+				return errors.Wrap(err, "listen quic")
+			}
+		}
+		l.fallback = true
+	}
+
+	if l.hidden = !getDiscovery(l.opt); l.hidden {
+		for _, n := range l.netlocs() {
+			l.mux.HideRoutes(n)
+		}
+	}
+
+	return nil
 }
 
+// netlocs returns every address the listener listens on, the primary one first
+func (l listener) netlocs() []netloc { return append([]netloc{l.netloc}, l.extra...) }
+
 func (l listener) Accept() (mangos.Pipe, error) {
-	conn, err := l.listenMux.Accept(l.Path)
-	if err != nil {
+	c, err := l.listenMux.Accept(l.rt)
+	if err == mangos.ErrClosed {
+		return nil, err // mangos compares against the sentinel itself
+	} else if err != nil {
 		return nil, errors.Wrap(err, "mux accept")
 	}
 
-	return mangos.NewConnPipe(conn, l.sock)
+	return newPipe(c, l.sock)
 }
 
 func (l listener) Close() error {
+	for _, n := range l.netlocs() {
+		if l.fallback {
+			l.mux.DelFallback(n)
+		}
+		if l.hidden {
+			l.mux.ShowRoutes(n)
+		}
+	}
+	close(l.rt.done) // unblock pending calls to Accept, and refuse new streams
+	l.rt.drain(getDrainTimeout(l.opt))
 	return l.listenMux.Close(l.Path)
 }
 
-func (l listener) GetOption(name string) (v interface{}, err error) { return l.opt.get(name) }
+func (l listener) GetOption(name string) (v interface{}, err error) {
+	if name == OptionBoundAddr {
+		return l.boundAddr()
+	}
+	return l.opt.get(name)
+}
+
+// boundAddr returns the local address the listener is bound to
+func (l listener) boundAddr() (net.Addr, error) {
+	if l.rev != nil {
+		if sess := l.rev.session(); sess != nil {
+			return sess.LocalAddr(), nil
+		}
+	} else if l.l != nil {
+		return l.l.Addr(), nil
+	}
+	return nil, errors.New("listener not bound")
+}
 func (l listener) SetOption(name string, v interface{}) (err error) { return l.opt.set(name, v) }
 
-func (l listener) Address() string { return l.URL.String() }
+// Address returns the listener's URL, with every host it listens on
+func (l listener) Address() string {
+	u := *l.URL
+	for _, n := range l.extra {
+		u.Host += "," + n.Host
+	}
+	return u.String()
+}
@@ -1,16 +1,23 @@
 package quic
 
 import (
+	"context"
 	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	quic "github.com/lucas-clemente/quic-go"
+	"github.com/nanomsg/mangos"
+	"github.com/pkg/errors"
 )
 
 func TestRefcntListener(t *testing.T) {
-	l := &mockLstn{}
-	rfcl := newRefCntListener(mockAddrNetloc(""), l, mux)
+	l := newMockLstn()
+	rfcl := newRefCntListener(mockAddrNetloc(""), l, newMux())
 
 	t.Run("CtrDefault=0", func(t *testing.T) {
 		if rfcl.refcnt != 0 {
@@ -60,7 +67,7 @@ func TestListenMux(t *testing.T) {
 	t.Run("LoadListener", func(t *testing.T) {
 		mx := newMux()
 		lm := newListenMux(mx, func(string, *tls.Config, *quic.Config) (quic.Listener, error) {
-			return &mockLstn{}, nil
+			return newMockLstn(), nil
 		})
 
 		if lm.l != nil {
@@ -104,23 +111,411 @@ func TestListenMux(t *testing.T) {
 		})
 	})
 
-	// t.Run("Accept", func(t *testing.T) {
-	// 	c, cancel := context.WithCancel(context.Background())
-	// 	defer cancel()
-
-	// 	mx := newMux()
-	// 	lm := newListenMux(mx, func(string, *tls.Config, *quic.Config) (quic.Listener, error) {
-	// 		return &mockLstn{sessFactory: func() *mockSess {
-	// 			return &mockSess{contextFactory: func() context.Context {
-	// 				return c
-	// 			}}
-	// 		}}, nil
-	// 	})
-	// 	defer lm.Close("") // make sure we break out of the FTick in Accept
-
-	// 	// TODO:  check if path was registered (chan exists at mux.router path)
-	// 	// TODO:  check if session was added to mx.sessions
-	// })
+	t.Run("GoAway", func(t *testing.T) {
+		l := newMockLstn()
+		lm := newListenMux(newMux(), func(string, *tls.Config, *quic.Config) (quic.Listener, error) {
+			return l, nil
+		})
+		if err := lm.LoadListener(netloc, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		// The accept loop holds a session before accepting the next one
+		sess := &mockSess{addr: "peer:1"}
+		l.sessions <- sess
+		l.sessions <- &mockSess{addr: "peer:2"}
+
+		l.onClose = func() {
+			if closed, code := sess.closeCode(); !closed || code != ErrorCodeGoingAway {
+				t.Errorf("listener closed before the session went away (closed: %t, code: %#x)", closed, code)
+			}
+		}
+		if err := lm.release(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("LoadExtraListener", func(t *testing.T) {
+		mx := newMux()
+		loaded := make(map[string]*mockLstn)
+		lm := newListenMux(mx, func(addr string, _ *tls.Config, _ *quic.Config) (quic.Listener, error) {
+			if addr == "bad:9001" {
+				return nil, errors.New("cannot bind")
+			}
+			loaded[addr] = newMockLstn()
+			return loaded[addr], nil
+		})
+
+		if err := lm.LoadListener(mockAddrNetloc("0.0.0.0:9001"), nil, nil); err != nil {
+			t.Fatal(err)
+		} else if err = lm.LoadExtraListener(mockAddrNetloc("[::]:9001"), nil, nil); err != nil {
+			t.Fatal(err)
+		} else if err = lm.LoadExtraListener(mockAddrNetloc("bad:9001"), nil, nil); err == nil {
+			t.Error("expected error")
+		}
+
+		if len(mx.listeners) != 2 || len(lm.extra) != 1 {
+			t.Errorf("expected 2 listeners, got %d (%d extra)", len(mx.listeners), len(lm.extra))
+		}
+
+		if err := lm.release(); err != nil {
+			t.Error(err)
+		} else if len(mx.listeners) != 0 {
+			t.Errorf("%d listeners still registered", len(mx.listeners))
+		}
+
+		for addr, l := range loaded {
+			if !l.closed {
+				t.Errorf("listener on %s not closed", addr)
+			}
+		}
+	})
+
+	t.Run("EphemeralPort", func(t *testing.T) {
+		mx := newMux()
+		factory := func(string, *tls.Config, *quic.Config) (quic.Listener, error) {
+			l := newMockLstn()
+			l.addr = "127.0.0.1:54321"
+			return l, nil
+		}
+
+		lm := newListenMux(mx, factory)
+		if err := lm.LoadListener(mockAddrNetloc("127.0.0.1:0"), nil, nil); err != nil {
+			t.Fatal(err)
+		} else if lm.l.netloc.Netloc() != "127.0.0.1:54321" {
+			t.Errorf("expected listener known by its bound port, got %s", lm.l.netloc.Netloc())
+		}
+
+		// later listeners on the bound port share the listener
+		other := newListenMux(mx, func(string, *tls.Config, *quic.Config) (quic.Listener, error) {
+			t.Error("listener on the bound port should have been shared")
+			return nil, errors.New("unreachable")
+		})
+		if err := other.LoadListener(mockAddrNetloc("127.0.0.1:54321"), nil, nil); err != nil {
+			t.Error(err)
+		} else if other.l != lm.l {
+			t.Error("listener not shared")
+		}
+
+		l := listener{listenMux: lm}
+		if v, err := l.GetOption(OptionBoundAddr); err != nil {
+			t.Error(err)
+		} else if v.(net.Addr).String() != "127.0.0.1:54321" {
+			t.Errorf("expected bound address 127.0.0.1:54321, got %s", v)
+		}
+
+		if _, err := (listener{listenMux: newListenMux(mx, factory)}).GetOption(OptionBoundAddr); err == nil {
+			t.Error("expected error before listening")
+		}
+	})
+
+	t.Run("AcceptTimeout", func(t *testing.T) {
+		lm := newListenMux(newMux(), func(string, *tls.Config, *quic.Config) (quic.Listener, error) {
+			return newMockLstn(), nil
+		})
+		if err := lm.LoadListener(netloc, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		defer lm.release()
+
+		rt := &route{ch: make(chan pendingConn), done: make(chan struct{}), timeout: time.Millisecond}
+		_, err := lm.Accept(rt)
+		if te, ok := err.(*TimeoutError); !ok || !te.Is(ErrAcceptTimeout) {
+			t.Errorf("expected ErrAcceptTimeout, got %v", err)
+		} else if !te.Timeout() {
+			t.Error("timeout error does not report a timeout")
+		}
+	})
+
+	t.Run("AcceptClosed", func(t *testing.T) {
+		lm := newListenMux(newMux(), func(string, *tls.Config, *quic.Config) (quic.Listener, error) {
+			return newMockLstn(), nil
+		})
+		if err := lm.LoadListener(netloc, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		defer lm.release()
+
+		l := listener{listenMux: lm, rt: &route{ch: make(chan pendingConn), done: make(chan struct{})}}
+		close(l.rt.done)
+		if _, err := l.Accept(); err != mangos.ErrClosed {
+			t.Errorf("expected bare ErrClosed, got %v", err)
+		}
+	})
+
+	t.Run("SharedSocket", func(t *testing.T) {
+		mx := newMux()
+		pc := &mockPacketConn{}
+		mx.network = mockNetwork(func(string) (net.PacketConn, error) { return pc, nil })
+
+		lm := newListenMux(mx, nil)
+		lm.factory = lm.listenShared(func(conn net.PacketConn, _ *tls.Config, _ *quic.Config) (quic.Listener, error) {
+			if conn.(*sharedConn).PacketConn != pc {
+				t.Error("listener not bound to the shared socket")
+			}
+			return newMockLstn(), nil
+		})
+
+		if err := lm.LoadListener(mockAddrNetloc("127.0.0.1:9001"), nil, nil); err != nil {
+			t.Fatal(err)
+		} else if len(mx.conns) != 1 {
+			t.Fatalf("expected 1 shared socket, got %d", len(mx.conns))
+		}
+
+		if err := lm.release(); err != nil {
+			t.Error(err)
+		} else if !pc.closed {
+			t.Error("socket not closed with the listener")
+		}
+	})
+
+	t.Run("LoadSession", func(t *testing.T) {
+		dials := make(chan context.CancelFunc, 4) // closes each dialed session
+		mx := newMux()
+		dm := newDialMux(nil, mx)
+		dm.factory = func(context.Context, string, *tls.Config, *quic.Config) (quic.Session, error) {
+			c, cancel := context.WithCancel(context.Background())
+			dials <- cancel
+			return &mockSess{contextFactory: func() context.Context { return c }}, nil
+		}
+
+		lm := newListenMux(mx, func(string, *tls.Config, *quic.Config) (quic.Listener, error) {
+			t.Error("reverse listener should not listen")
+			return nil, nil
+		})
+
+		if err := lm.LoadSession(dm, netloc, nil, nil); err != nil {
+			t.Fatal(err)
+		} else if sess := lm.rev.session(); sess == nil || sess.served != 1 {
+			t.Error("dialed session not served")
+		}
+		first := lm.rev.session()
+
+		ch := make(chan error)
+		go func() {
+			_, err := lm.Accept(&route{})
+			ch <- err
+		}()
+
+		t.Run("Redial", func(t *testing.T) {
+			(<-dials)()
+			select {
+			case <-dials:
+			case <-time.After(time.Second):
+				t.Fatal("session not redialed once the peer dropped it")
+			}
+
+			select {
+			case err := <-ch:
+				t.Errorf("Accept returned while redialing: %v", err)
+			case <-time.After(10 * time.Millisecond):
+			}
+
+			if sess := lm.rev.session(); sess == nil || sess == first {
+				t.Error("redialed session not served")
+			}
+		})
+
+		if err := lm.Close("/agent/metrics"); err != nil {
+			t.Error(err)
+		}
+
+		select {
+		case err := <-ch:
+			if err != mangos.ErrClosed {
+				t.Errorf("expected ErrClosed, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Error("Accept did not return when the listener was closed")
+		}
+
+		select {
+		case <-dials:
+			t.Error("session redialed after the listener was closed")
+		case <-time.After(2 * defaultReconnectTime):
+		}
+	})
+
+	t.Run("ReverseRelease", func(t *testing.T) {
+		newReverse := func(mx *multiplexer) (*listenMux, chan struct{}) {
+			dialed := make(chan struct{}, 4)
+			dm := newDialMux(nil, mx)
+			dm.factory = func(context.Context, string, *tls.Config, *quic.Config) (quic.Session, error) {
+				dialed <- struct{}{}
+				return &mockSess{}, nil
+			}
+
+			lm := newListenMux(mx, nil)
+			if err := lm.LoadSession(dm, netloc, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			<-dialed
+			return lm, dialed
+		}
+
+		// e.g. Listen failing once the session is loaded
+		t.Run("Immediate", func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				lm, _ := newReverse(newMux())
+				if err := lm.release(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			time.Sleep(10 * time.Millisecond) // let the redial goroutines observe it
+		})
+
+		t.Run("TransportClose", func(t *testing.T) {
+			mx := newMux()
+			lm, dialed := newReverse(mx)
+
+			ch := make(chan error)
+			go func() {
+				_, err := lm.Accept(&route{})
+				ch <- err
+			}()
+
+			if err := mx.Close(); err != nil {
+				t.Error(err)
+			}
+
+			select {
+			case err := <-ch:
+				if err != mangos.ErrClosed {
+					t.Errorf("expected ErrClosed, got %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Error("Accept did not return when the transport was closed")
+			}
+
+			select {
+			case <-dialed:
+				t.Error("session redialed after the transport was closed")
+			case <-time.After(2 * defaultReconnectTime):
+			}
+
+			if err := lm.release(); err != nil {
+				t.Error(err)
+			}
+		})
+	})
+
+	t.Run("Accept", func(t *testing.T) {
+		const sessions, acceptors, streams = 16, 8, 512
+
+		c, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var listens int32
+		ml := newMockLstn()
+		mx := newMux()
+		lm := newListenMux(mx, func(string, *tls.Config, *quic.Config) (quic.Listener, error) {
+			atomic.AddInt32(&listens, 1)
+			return ml, nil
+		})
+
+		// both paths share the listener, and thus its accept loop
+		for range []string{"/a", "/b"} {
+			if err := lm.LoadListener(netloc, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if listens != 1 {
+			t.Errorf("expected 1 listener, got %d", listens)
+		}
+
+		var accepted []*mockSess
+		t.Run("AcceptLoop", func(t *testing.T) {
+			for i := 0; i < sessions; i++ {
+				sess := &mockSess{
+					addr:           mockAddrNetloc(fmt.Sprintf("10.0.0.1:%d", 1024+i)),
+					contextFactory: func() context.Context { return c },
+				}
+				ml.sessions <- sess
+				accepted = append(accepted, sess)
+			}
+
+			deadline := time.Now().Add(time.Second)
+			for {
+				mx.Lock()
+				n := len(mx.inbound)
+				mx.Unlock()
+
+				if n == sessions {
+					break
+				} else if time.Now().After(deadline) {
+					t.Fatalf("expected %d sessions, got %d", sessions, n)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+
+		t.Run("ConcurrentAccept", func(t *testing.T) {
+			rt := &route{ch: make(chan pendingConn, streams), done: make(chan struct{})}
+			if err := lm.Register("/a", rt); err != nil {
+				t.Fatal(err)
+			} else if err = lm.Register("/a", rt); err == nil {
+				t.Error("path registered twice")
+			}
+
+			var wg sync.WaitGroup
+			accepted := make(chan net.Conn, streams)
+			for i := 0; i < acceptors; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						c, err := lm.Accept(rt)
+						if err != nil {
+							return
+						}
+						accepted <- c
+					}
+				}()
+			}
+
+			for i := 0; i < streams; i++ {
+				go func() {
+					stream := newMockStream()
+					if err := newNegotiator(stream).WriteHeaders(request{path: "/a"}); err != nil {
+						t.Error(err)
+					}
+					mx.routeStream(netloc, &mockSess{}, stream)
+				}()
+			}
+
+			seen := make(map[net.Conn]bool)
+			for len(seen) < streams {
+				select {
+				case c := <-accepted:
+					if seen[c] {
+						t.Fatal("stream accepted twice")
+					}
+					seen[c] = true
+				case <-time.After(time.Second):
+					t.Fatalf("accepted %d of %d streams", len(seen), streams)
+				}
+			}
+
+			close(rt.done)
+			wg.Wait() // every Accept returns once the route is closed
+		})
+
+		if err := lm.Close("/a"); err != nil {
+			t.Error(err)
+		} else if err = lm.Close("/b"); err != nil {
+			t.Error(err)
+		} else if !ml.closed {
+			t.Error("listener not closed")
+		}
+
+		// sessions are told we're going away once the listener is closed
+		time.Sleep(time.Millisecond * 10)
+		for _, sess := range accepted {
+			if _, code := sess.closeCode(); code != ErrorCodeGoingAway {
+				t.Errorf("expected session closed with %#x, got %#x", ErrorCodeGoingAway, code)
+			}
+		}
+	})
 }
 
 func TestListener(t *testing.T) {
@@ -0,0 +1,204 @@
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/SentimensRG/ctx"
+	quic "github.com/lucas-clemente/quic-go"
+	"github.com/pkg/errors"
+)
+
+// memQueueLen is the number of packets a memConn holds before it drops more,
+// as a full UDP receive buffer would
+const memQueueLen = 1024
+
+var (
+	errMemClosed    = errors.New("use of closed mem connection")
+	errMemAddrInUse = errors.New("address already in use")
+)
+
+// memAddr is the address of a memConn, i.e. the host of a quic+mem:// URL
+type memAddr string
+
+func (memAddr) Network() string  { return "mem" }
+func (a memAddr) String() string { return string(a) }
+
+// memNetwork is the packetNetwork of quic+mem:// transports.  Its sockets live
+// in memory, and deliver packets to one another by address.
+type memNetwork struct {
+	sync.Mutex
+	conns map[memAddr]*memConn
+	next  int // suffix of the next ephemeral address
+}
+
+func newMemNetwork() *memNetwork { return &memNetwork{conns: make(map[memAddr]*memConn)} }
+
+func (nw *memNetwork) ResolveAddr(addr string) (net.Addr, error) {
+	if addr == "" {
+		return nil, errors.New("missing mem address")
+	}
+	return memAddr(addr), nil
+}
+
+// ListenPacket opens a socket bound to addr, or to an ephemeral address if addr
+// is empty
+func (nw *memNetwork) ListenPacket(addr string) (net.PacketConn, error) {
+	nw.Lock()
+	defer nw.Unlock()
+
+	a := memAddr(addr)
+	if a == "" {
+		a = memAddr(fmt.Sprintf("ephemeral-%d", nw.next))
+		nw.next++
+	}
+
+	if _, ok := nw.conns[a]; ok {
+		return nil, errors.Wrap(errMemAddrInUse, addr)
+	}
+
+	c := &memConn{
+		nw:   nw,
+		addr: a,
+		in:   make(chan memPacket, memQueueLen),
+		done: make(chan struct{}),
+	}
+	nw.conns[a] = c
+	return c, nil
+}
+
+// DialAddr dials a session to addr from an ephemeral socket, which is closed
+// along with the session
+func (nw *memNetwork) DialAddr(c context.Context, addr string, tc *tls.Config, qc *quic.Config) (quic.Session, error) {
+	pc, err := nw.ListenPacket("")
+	if err != nil {
+		return nil, err
+	}
+
+	qs, err := quic.DialContext(c, pc, memAddr(addr), addr, memTLSConfig(addr, tc), qc)
+	if err != nil {
+		_ = pc.Close()
+		return nil, err
+	}
+
+	ctx.Defer(qs.Context(), func() { _ = pc.Close() })
+	return qs, nil
+}
+
+// memTLSConfig returns tc, or a copy of it naming the server addr if addr has
+// no port.  quic-go otherwise takes the server name from the host:port it
+// dials, and fails on mem hosts, which need no port.
+func memTLSConfig(addr string, tc *tls.Config) *tls.Config {
+	if _, _, err := net.SplitHostPort(addr); err == nil || (tc != nil && tc.ServerName != "") {
+		return tc
+	}
+
+	if tc == nil {
+		tc = &tls.Config{}
+	} else {
+		tc = tc.Clone()
+	}
+	tc.ServerName = addr
+	return tc
+}
+
+func (nw *memNetwork) lookup(a net.Addr) (c *memConn, ok bool) {
+	nw.Lock()
+	c, ok = nw.conns[memAddr(a.String())]
+	nw.Unlock()
+	return
+}
+
+type memPacket struct {
+	b    []byte
+	from memAddr
+}
+
+// memConn is a net.PacketConn on a memNetwork.  Like UDP, it drops packets sent
+// to unknown addresses, or while its peer's queue is full.  Read deadlines are
+// taken into account when a read starts.
+type memConn struct {
+	nw   *memNetwork
+	addr memAddr
+	in   chan memPacket
+	once sync.Once
+	done chan struct{}
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (c *memConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	d := c.deadline
+	c.mu.Unlock()
+
+	var expired <-chan time.Time
+	if !d.IsZero() {
+		t := time.NewTimer(time.Until(d))
+		defer t.Stop()
+		expired = t.C
+	}
+
+	select {
+	case p := <-c.in:
+		return copy(b, p.b), p.from, nil
+	case <-c.done:
+		return 0, nil, errMemClosed
+	case <-expired:
+		return 0, nil, memTimeoutError{}
+	}
+}
+
+func (c *memConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, errMemClosed
+	default:
+	}
+
+	peer, ok := c.nw.lookup(addr)
+	if !ok {
+		return len(b), nil
+	}
+
+	select {
+	case peer.in <- memPacket{b: append([]byte(nil), b...), from: c.addr}:
+	default:
+	}
+	return len(b), nil
+}
+
+func (c *memConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+
+		c.nw.Lock()
+		delete(c.nw.conns, c.addr)
+		c.nw.Unlock()
+	})
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr { return c.addr }
+
+func (c *memConn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (*memConn) SetWriteDeadline(time.Time) error { return nil }
+
+type memTimeoutError struct{}
+
+func (memTimeoutError) Error() string   { return "i/o timeout" }
+func (memTimeoutError) Timeout() bool   { return true }
+func (memTimeoutError) Temporary() bool { return true }
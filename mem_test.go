@@ -0,0 +1,239 @@
+package quic
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nanomsg/mangos"
+	"github.com/nanomsg/mangos/protocol/pair"
+)
+
+func TestMemNetwork(t *testing.T) {
+	nw := newMemNetwork()
+
+	server, err := nw.ListenPacket("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := nw.ListenPacket("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	t.Run("AddrInUse", func(t *testing.T) {
+		if _, err := nw.ListenPacket("server"); err == nil {
+			t.Error("expected error for address in use")
+		}
+	})
+
+	t.Run("Ephemeral", func(t *testing.T) {
+		pc, err := nw.ListenPacket("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pc.Close()
+
+		if pc.LocalAddr() == client.LocalAddr() {
+			t.Errorf("ephemeral address %s handed out twice", pc.LocalAddr())
+		}
+	})
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		if _, err := client.WriteTo([]byte("ping"), memAddr("server")); err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, 16)
+		n, from, err := server.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		} else if string(b[:n]) != "ping" {
+			t.Errorf("expected ping, got %s", b[:n])
+		} else if from != client.LocalAddr() {
+			t.Errorf("expected packet from %s, got %s", client.LocalAddr(), from)
+		}
+	})
+
+	t.Run("UnknownPeer", func(t *testing.T) {
+		if n, err := client.WriteTo([]byte("lost"), memAddr("nobody")); err != nil || n != 4 {
+			t.Errorf("expected packet silently dropped, got %d, %v", n, err)
+		}
+	})
+
+	t.Run("Deadline", func(t *testing.T) {
+		_ = server.SetReadDeadline(time.Now().Add(time.Millisecond))
+		defer server.SetReadDeadline(time.Time{})
+
+		if _, _, err := server.ReadFrom(make([]byte, 16)); !isTimeout(err) {
+			t.Errorf("expected timeout, got %v", err)
+		}
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		pc, _ := nw.ListenPacket("closing")
+		if err := pc.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := pc.ReadFrom(make([]byte, 16)); err != errMemClosed {
+			t.Errorf("expected errMemClosed, got %v", err)
+		} else if _, err = pc.WriteTo([]byte("x"), memAddr("server")); err != errMemClosed {
+			t.Errorf("expected errMemClosed, got %v", err)
+		}
+
+		if pc, err := nw.ListenPacket("closing"); err != nil {
+			t.Errorf("address not freed: %v", err)
+		} else {
+			_ = pc.Close()
+		}
+	})
+}
+
+func TestNewMemTransport(t *testing.T) {
+	trans := NewMemTransport()
+	if trans.Scheme() != "quic+mem" {
+		t.Errorf("expected scheme quic+mem, got %s", trans.Scheme())
+	}
+
+	if key, err := sessionKey(trans.mux, mockAddrNetloc("server"), nil, ""); err != nil {
+		t.Error(err)
+	} else if key != "server" {
+		t.Errorf("expected session key server, got %s", key)
+	}
+
+	trans.mux.Lock()
+	defer trans.mux.Unlock()
+
+	c, err := trans.mux.LoadConn("server")
+	if err != nil {
+		t.Fatal(err)
+	} else if _, ok := c.PacketConn.(*memConn); !ok {
+		t.Errorf("expected in-memory socket, got %T", c.PacketConn)
+	}
+	_ = trans.mux.ReleaseConn(c)
+}
+
+func TestMemTLSConfig(t *testing.T) {
+	tc := &tls.Config{InsecureSkipVerify: true}
+
+	if c := memTLSConfig("server", tc); c == tc || c.ServerName != "server" || !c.InsecureSkipVerify {
+		t.Errorf("expected a copy naming the server, got %+v", c)
+	} else if tc.ServerName != "" {
+		t.Error("caller's config modified")
+	}
+
+	if c := memTLSConfig("server", nil); c == nil || c.ServerName != "server" {
+		t.Errorf("expected a config naming the server, got %+v", c)
+	}
+
+	if memTLSConfig("server:9001", tc) != tc {
+		t.Error("config copied although the server name can be taken from the port")
+	}
+
+	named := &tls.Config{ServerName: "example.com"}
+	if memTLSConfig("server", named) != named {
+		t.Error("config copied although it names the server")
+	}
+}
+
+func TestMemTransportDial(t *testing.T) {
+	opt := map[string]interface{}{OptionDialTimeout: 10 * time.Millisecond}
+
+	// Sessions are dialed from an ephemeral socket on the transport's network,
+	// rather than over UDP, whichever path dials them.
+	t.Run("Discover", func(t *testing.T) {
+		trans := NewMemTransport()
+		if _, err := trans.Discover("quic+mem://nobody", opt); err == nil {
+			t.Error("discovered routes of a missing peer")
+		} else if trans.mem.next != 1 {
+			t.Errorf("expected 1 mem socket dialed from, got %d", trans.mem.next)
+		}
+	})
+
+	t.Run("Reverse", func(t *testing.T) {
+		trans := NewMemTransport()
+		p, err := trans.NewListener("quic+mem://nobody/agent", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l := p.(*listener)
+		for name, v := range opt {
+			_ = l.SetOption(name, v)
+		}
+		_ = l.SetOption(OptionReverse, true)
+
+		if err = l.Listen(); err == nil {
+			t.Error("reverse listener dialed a missing peer")
+		} else if trans.mem.next != 1 {
+			t.Errorf("expected 1 mem socket dialed from, got %d", trans.mem.next)
+		}
+	})
+}
+
+func TestMemTransport(t *testing.T) {
+	const addr = "quic+mem://server/echo"
+	trans := NewMemTransport()
+
+	newSocket := func() mangos.Socket {
+		sock, err := pair.NewSocket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sock.AddTransport(trans)
+		_ = sock.SetOption(mangos.OptionRecvDeadline, 5*time.Second)
+		return sock
+	}
+
+	s0 := newSocket()
+	defer s0.Close()
+	if err := s0.Listen(addr); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Discover", func(t *testing.T) {
+		routes, err := trans.Discover("quic+mem://server", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := s0.GetProtocol()
+		want := []RouteInfo{{Path: "/echo", Protocol: p.Number(), PeerProtocol: p.PeerNumber()}}
+		if !reflect.DeepEqual(routes, want) {
+			t.Errorf("expected routes %v, got %v", want, routes)
+		}
+	})
+
+	s1 := newSocket()
+	defer s1.Close()
+	if err := s1.Dial(addr); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("SendRecv", func(t *testing.T) {
+		if err := s1.Send([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+
+		if b, err := s0.Recv(); err != nil {
+			t.Fatal(err)
+		} else if string(b) != "ping" {
+			t.Errorf("expected ping, got %s", b)
+		}
+
+		if err := s0.Send([]byte("pong")); err != nil {
+			t.Fatal(err)
+		}
+
+		if b, err := s1.Recv(); err != nil {
+			t.Fatal(err)
+		} else if string(b) != "pong" {
+			t.Errorf("expected pong, got %s", b)
+		}
+	})
+}
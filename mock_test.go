@@ -1,10 +1,16 @@
 package quic
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"net"
+	"sync"
+	"time"
 
 	quic "github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/qerr"
+	"github.com/pkg/errors"
 )
 
 var ( // interface constraints
@@ -12,6 +18,7 @@ var ( // interface constraints
 	_ netlocator    = mockAddrNetloc("")
 	_ quic.Listener = &mockLstn{}
 	_ quic.Session  = &mockSess{}
+	_ quic.Stream   = &mockStream{}
 )
 
 type mockAddrNetloc string
@@ -21,49 +28,214 @@ func (m mockAddrNetloc) String() string { return string(m) }
 func (m mockAddrNetloc) Netloc() string { return m.String() }
 
 type mockLstn struct {
-	closed      bool
-	sessFactory func() *mockSess
+	addr     mockAddrNetloc // bound address
+	closed   bool
+	once     sync.Once
+	cq       chan struct{}
+	sessions chan quic.Session // sessions for Accept to return
+	onClose  func()            // called as Close begins
 }
 
-func (m mockLstn) Accept() (quic.Session, error) {
-	if m.sessFactory == nil {
-		return &mockSess{}, nil
+func newMockLstn() *mockLstn {
+	return &mockLstn{cq: make(chan struct{}), sessions: make(chan quic.Session)}
+}
+
+func (m *mockLstn) Accept() (quic.Session, error) {
+	select {
+	case sess := <-m.sessions:
+		return sess, nil
+	case <-m.cq:
+		return nil, errors.New("listener closed")
 	}
-	return m.sessFactory(), nil
 }
 
-func (mockLstn) Addr() net.Addr                 { return mockAddrNetloc("") }
-func (mockLstn) Listen() (quic.Listener, error) { return nil, nil }
+func (m *mockLstn) Addr() net.Addr               { return m.addr }
+func (*mockLstn) Listen() (quic.Listener, error) { return nil, nil }
 func (m *mockLstn) Close() error {
+	if m.onClose != nil {
+		m.onClose()
+	}
 	m.closed = true
+	m.once.Do(func() { close(m.cq) })
 	return nil
 }
 
 type mockSess struct {
+	mu             sync.Mutex
+	addr           mockAddrNetloc
 	closed         bool
+	code           quic.ErrorCode // passed to CloseWithError
+	saturated      bool           // OpenStream fails as if the peer's stream limit was hit
 	contextFactory func() context.Context
+	streamFactory  func() quic.Stream
 }
 
-func (mockSess) AcceptStream() (quic.Stream, error) { return nil, nil }
+// AcceptStream blocks until the session's context expires, as if the peer
+// never opened a stream, and then fails with the session's close code
+func (m *mockSess) AcceptStream() (quic.Stream, error) {
+	<-m.Context().Done()
+	_, code := m.closeCode()
+	return nil, qerr.Error(qerr.ErrorCode(code), "session closed")
+}
 
-func (m mockSess) Context() context.Context {
+func (m *mockSess) Context() context.Context {
 	if m.contextFactory == nil {
 		return context.TODO()
 	}
 	return m.contextFactory()
 }
 
-func (mockSess) LocalAddr() net.Addr                          { return mockAddrNetloc("") }
-func (mockSess) OpenStream() (quic.Stream, error)             { return nil, nil }
-func (mockSess) OpenStreamSync() (quic.Stream, error)         { return nil, nil }
-func (mockSess) RemoteAddr() net.Addr                         { return mockAddrNetloc("") }
-func (mockSess) AcceptUniStream() (quic.ReceiveStream, error) { return nil, nil }
-func (mockSess) OpenUniStream() (quic.SendStream, error)      { return nil, nil }
-func (mockSess) OpenUniStreamSync() (quic.SendStream, error)  { return nil, nil }
-func (mockSess) CloseWithError(quic.ErrorCode, error) error   { return nil }
+func (*mockSess) LocalAddr() net.Addr { return mockAddrNetloc("") }
+
+func (m *mockSess) OpenStream() (quic.Stream, error) {
+	if m.saturated {
+		return nil, saturatedError{}
+	}
+	return m.OpenStreamSync()
+}
+
+func (m *mockSess) OpenStreamSync() (quic.Stream, error) {
+	if closed, code := m.closeCode(); closed {
+		return nil, qerr.Error(qerr.ErrorCode(code), "session closed")
+	} else if m.streamFactory == nil {
+		return nil, nil
+	}
+	return m.streamFactory(), nil
+}
+
+func (m *mockSess) RemoteAddr() net.Addr                       { return m.addr }
+func (*mockSess) AcceptUniStream() (quic.ReceiveStream, error) { return nil, nil }
+func (*mockSess) OpenUniStream() (quic.SendStream, error)      { return nil, nil }
+func (*mockSess) OpenUniStreamSync() (quic.SendStream, error)  { return nil, nil }
+func (m *mockSess) CloseWithError(code quic.ErrorCode, _ error) error {
+	m.mu.Lock()
+	m.closed, m.code = true, code
+	m.mu.Unlock()
+	return nil
+}
+
 func (m *mockSess) Close() error {
+	m.mu.Lock()
 	m.closed = true
+	m.mu.Unlock()
 	return nil
 }
 
+func (m *mockSess) closeCode() (bool, quic.ErrorCode) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed, m.code
+}
+
 func (*mockSess) ConnectionState() quic.ConnectionState { return quic.ConnectionState{} }
+
+// mockNetwork is a udpNetwork whose sockets are opened by calling it
+type mockNetwork func(addr string) (net.PacketConn, error)
+
+func (mockNetwork) ResolveAddr(addr string) (net.Addr, error)          { return udpNetwork{}.ResolveAddr(addr) }
+func (m mockNetwork) ListenPacket(addr string) (net.PacketConn, error) { return m(addr) }
+func (mockNetwork) DialAddr(c context.Context, addr string, tc *tls.Config, qc *quic.Config) (quic.Session, error) {
+	return udpNetwork{}.DialAddr(c, addr, tc, qc)
+}
+
+// mockPacketConn stands in for a UDP socket.  Only Close may be called on it.
+type mockPacketConn struct {
+	net.PacketConn
+	closed bool
+}
+
+func (m *mockPacketConn) Close() error {
+	m.closed = true
+	return nil
+}
+
+// mockStream is a quic.Stream backed by a bufCloser.  Bytes written to it can be
+// read back, so both sides of a negotiation can be played through it.
+type mockStream struct{ *bufCloser }
+
+func newMockStream() *mockStream { return &mockStream{&bufCloser{Buffer: new(bytes.Buffer)}} }
+
+func (mockStream) StreamID() quic.StreamID          { return 0 }
+func (mockStream) CancelRead(quic.ErrorCode) error  { return nil }
+func (mockStream) CancelWrite(quic.ErrorCode) error { return nil }
+func (mockStream) Context() context.Context         { return context.TODO() }
+func (mockStream) SetDeadline(time.Time) error      { return nil }
+func (mockStream) SetReadDeadline(time.Time) error  { return nil }
+func (mockStream) SetWriteDeadline(time.Time) error { return nil }
+
+// ctxStream is a mockStream whose context is controlled by the test, e.g. to
+// close it
+type ctxStream struct {
+	*mockStream
+	ctx context.Context
+}
+
+func (s ctxStream) Context() context.Context { return s.ctx }
+
+// replyStream is a mockStream whose peer answers with a canned reply.  What is
+// written to it is recorded separately from what is read.
+type replyStream struct {
+	*mockStream
+	reply *bytes.Reader
+}
+
+func newReplyStream(reply []byte) *replyStream {
+	return &replyStream{mockStream: newMockStream(), reply: bytes.NewReader(reply)}
+}
+
+func (s *replyStream) Read(b []byte) (int, error) { return s.reply.Read(b) }
+
+// stallStream is a mockStream whose peer never writes anything:  reads block
+// until the read deadline expires.  Writes are recorded as usual.
+// deadlineStream is a mockStream that records the last deadline set on it
+type deadlineStream struct {
+	*mockStream
+	deadline time.Time
+}
+
+func (s *deadlineStream) SetDeadline(t time.Time) error {
+	s.deadline = t
+	return nil
+}
+
+type stallStream struct {
+	*mockStream
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func newStallStream() *stallStream { return &stallStream{mockStream: newMockStream()} }
+
+func (s *stallStream) SetDeadline(t time.Time) error { return s.SetReadDeadline(t) }
+
+func (s *stallStream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.deadline = t
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *stallStream) Read([]byte) (int, error) {
+	s.mu.Lock()
+	d := s.deadline
+	s.mu.Unlock()
+
+	if d.IsZero() {
+		select {} // stalled forever
+	}
+
+	time.Sleep(time.Until(d))
+	return 0, timeoutError{}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "deadline exceeded" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type saturatedError struct{}
+
+func (saturatedError) Error() string   { return "too many open streams" }
+func (saturatedError) Timeout() bool   { return false }
+func (saturatedError) Temporary() bool { return true }
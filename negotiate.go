@@ -0,0 +1,518 @@
+package quic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nanomsg/mangos"
+	"github.com/pkg/errors"
+)
+
+// Path negotiation
+//
+// Every stream opened by a dialer begins with a short exchange of frames in
+// which the dialer names the path it wants, and the listener either accepts the
+// stream or aborts it with a status code.  A frame is laid out as follows:
+//
+//	magic   [4]byte   "\x00QMN"
+//	version uint8
+//	kind    uint8
+//	length  uint32    big-endian length of body
+//	body    [length]byte
+//	trailer uint8     '\n'
+//
+// The body is a sequence of fields, each encoded as a tag (uint8), a big-endian
+// uint16 length and a value.  Unknown tags are skipped, so fields can be added
+// without bumping the version.
+//
+// The leading NUL byte never begins a legacy (newline-delimited) header, which
+// lets either side tell a legacy peer apart from a current one.  Legacy
+// listeners read their header up to the first '\n', which may well be a byte of
+// the length or body, e.g. the length of a 10-byte path.  The trailing newline
+// only guarantees that there is one within the frame, so that they never block
+// on a header that never ends.  Wherever they stop, the path they read begins
+// with a NUL byte and matches no route, so they answer with a 404.
+
+const negotiationVersion uint8 = 1
+
+var magic = [4]byte{0x00, 'Q', 'M', 'N'}
+
+const (
+	frameHeaderLen = len(magic) + 1 + 1 + 4
+	maxFrameLen    = 1 << 16
+	maxLegacyLen   = 4096
+)
+
+// frame kinds
+const (
+	kindRequest uint8 = iota + 1
+	kindAccept
+	kindAbort
+	kindRedirect
+	kindRoutes // answer to a stream negotiated on DiscoveryPath
+)
+
+// field tags
+const (
+	fieldPath uint8 = iota + 1
+	fieldStatus
+	fieldMessage
+	fieldHeader // uint16 key length, key, value
+	fieldProto  // uint16 SP protocol number, uint16 peer protocol number
+	fieldNetloc
+	fieldCodec // name of a compression codec; repeated in requests
+	fieldRoute // uint16 SP protocol number, uint16 peer protocol number, path
+)
+
+var errLegacyPeer = errors.New("peer does not support versioned negotiation")
+
+type field struct {
+	tag uint8
+	val []byte
+}
+
+type frame struct {
+	kind   uint8
+	fields []field
+}
+
+func (f *frame) add(tag uint8, val []byte) { f.fields = append(f.fields, field{tag: tag, val: val}) }
+
+func (f *frame) addUint16(tag uint8, v uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	f.add(tag, b[:])
+}
+
+// get returns the value of the first field with the given tag
+func (f frame) get(tag uint8) (val []byte, ok bool) {
+	for _, fd := range f.fields {
+		if fd.tag == tag {
+			return fd.val, true
+		}
+	}
+	return
+}
+
+// all returns the values of every field with the given tag, in order
+func (f frame) all(tag uint8) (vals [][]byte) {
+	for _, fd := range f.fields {
+		if fd.tag == tag {
+			vals = append(vals, fd.val)
+		}
+	}
+	return
+}
+
+func (f frame) getUint16(tag uint8) (v uint16, ok bool) {
+	var b []byte
+	if b, ok = f.get(tag); ok {
+		if ok = len(b) == 2; ok {
+			v = binary.BigEndian.Uint16(b)
+		}
+	}
+	return
+}
+
+func (f frame) MarshalBinary() ([]byte, error) {
+	var body bytes.Buffer
+	for _, fd := range f.fields {
+		if len(fd.val) > math.MaxUint16 {
+			return nil, errors.Errorf("field %d exceeds %d bytes", fd.tag, math.MaxUint16)
+		}
+
+		var l [2]byte
+		binary.BigEndian.PutUint16(l[:], uint16(len(fd.val)))
+
+		body.WriteByte(fd.tag)
+		body.Write(l[:])
+		body.Write(fd.val)
+	}
+
+	if body.Len() > maxFrameLen {
+		return nil, errors.Errorf("frame exceeds %d bytes", maxFrameLen)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, frameHeaderLen+body.Len()+1))
+	buf.Write(magic[:])
+	buf.WriteByte(negotiationVersion)
+	buf.WriteByte(f.kind)
+
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(body.Len()))
+	buf.Write(l[:])
+	buf.Write(body.Bytes())
+	buf.WriteByte('\n')
+
+	return buf.Bytes(), nil
+}
+
+func (f *frame) UnmarshalBinary(b []byte) error {
+	if len(b) < frameHeaderLen+1 {
+		return io.ErrUnexpectedEOF
+	} else if !bytes.Equal(b[:len(magic)], magic[:]) {
+		return errLegacyPeer
+	} else if v := b[len(magic)]; v != negotiationVersion {
+		return errors.Errorf("unsupported negotiation version %d", v)
+	}
+
+	f.kind = b[len(magic)+1]
+	f.fields = f.fields[:0]
+
+	l := binary.BigEndian.Uint32(b[len(magic)+2 : frameHeaderLen])
+	if l > maxFrameLen {
+		return errors.Errorf("frame exceeds %d bytes", maxFrameLen)
+	} else if uint32(len(b)) != uint32(frameHeaderLen)+l+1 {
+		return errors.New("frame length mismatch")
+	} else if b[len(b)-1] != '\n' {
+		return errors.New("missing frame trailer")
+	}
+
+	for body := b[frameHeaderLen : len(b)-1]; len(body) > 0; {
+		if len(body) < 3 {
+			return errors.New("truncated field")
+		}
+
+		tag, n := body[0], int(binary.BigEndian.Uint16(body[1:3]))
+		if body = body[3:]; len(body) < n {
+			return errors.Errorf("truncated field %d", tag)
+		}
+
+		f.add(tag, body[:n:n])
+		body = body[n:]
+	}
+
+	return nil
+}
+
+// readFrame reads exactly one frame from r, never consuming bytes past the
+// trailer.
+func readFrame(r io.Reader) (f frame, err error) {
+	hdr := make([]byte, frameHeaderLen)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return
+	}
+
+	if !bytes.Equal(hdr[:len(magic)], magic[:]) {
+		err = errLegacyPeer
+		return
+	}
+
+	l := binary.BigEndian.Uint32(hdr[len(magic)+2:])
+	if l > maxFrameLen {
+		err = errors.Errorf("frame exceeds %d bytes", maxFrameLen)
+		return
+	}
+
+	b := make([]byte, frameHeaderLen+int(l)+1)
+	copy(b, hdr)
+	if _, err = io.ReadFull(r, b[frameHeaderLen:]); err == nil {
+		err = f.UnmarshalBinary(b)
+	}
+
+	return
+}
+
+func writeFrame(w io.Writer, f frame) error {
+	b, err := f.MarshalBinary()
+	if err == nil {
+		_, err = w.Write(b)
+	}
+	return err
+}
+
+// readLine reads a newline-terminated legacy header one byte at a time, so that
+// nothing beyond the newline is consumed.  The bytes read so far are returned
+// alongside any error.
+func readLine(r io.Reader) (string, error) {
+	var (
+		line []byte
+		b    [1]byte
+	)
+
+	for len(line) < maxLegacyLen {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return string(line), err
+		} else if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+
+	return string(line), errors.Errorf("legacy header exceeds %d bytes", maxLegacyLen)
+}
+
+// Headers carry application-defined metadata alongside the path of a
+// negotiated stream.
+type Headers map[string]string
+
+func (h Headers) encode(f *frame) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) // deterministic encoding
+
+	for _, k := range keys {
+		b := make([]byte, 2, 2+len(k)+len(h[k]))
+		binary.BigEndian.PutUint16(b, uint16(len(k)))
+		f.add(fieldHeader, append(append(b, k...), h[k]...))
+	}
+}
+
+func (h Headers) decode(f frame) error {
+	for _, b := range f.all(fieldHeader) {
+		if len(b) < 2 {
+			return errors.New("truncated header")
+		}
+
+		l := int(binary.BigEndian.Uint16(b))
+		if len(b) < 2+l {
+			return errors.New("truncated header key")
+		}
+
+		h[string(b[2:2+l])] = string(b[2+l:])
+	}
+	return nil
+}
+
+// spProto identifies an SP protocol by its number and that of its peer
+type spProto struct{ number, peer uint16 }
+
+func sockProto(sock mangos.Socket) *spProto {
+	p := sock.GetProtocol()
+	return &spProto{number: p.Number(), peer: p.PeerNumber()}
+}
+
+// compatible reports whether the two protocols can talk to each other
+func (p spProto) compatible(q spProto) bool { return p.number == q.peer && p.peer == q.number }
+
+func (p *spProto) encode(f *frame) {
+	if p != nil {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint16(b, p.number)
+		binary.BigEndian.PutUint16(b[2:], p.peer)
+		f.add(fieldProto, b)
+	}
+}
+
+func decodeProto(f frame) (*spProto, error) {
+	b, ok := f.get(fieldProto)
+	if !ok {
+		return nil, nil
+	} else if len(b) != 4 {
+		return nil, errors.New("malformed protocol")
+	}
+
+	return &spProto{
+		number: binary.BigEndian.Uint16(b),
+		peer:   binary.BigEndian.Uint16(b[2:]),
+	}, nil
+}
+
+// request is sent by the dialer at the start of each stream
+type request struct {
+	path    string
+	headers Headers
+	proto   *spProto // nil if the dialer did not announce its protocol
+	codecs  []string // compression codecs offered, in order of preference
+}
+
+// response is sent by the listener when it accepts a stream
+type response struct {
+	proto *spProto // nil if the listener did not announce its protocol
+	codec string   // compression codec picked from the request, if any
+}
+
+type (
+	listenNegotiator interface {
+		ReadHeaders() (request, error)
+		Abort(int, string) error
+		Redirect(*Redirect) error
+		Accept(response) error
+	}
+
+	dialNegotiator interface {
+		WriteHeaders(request) error
+		Ack() (response, error)
+	}
+)
+
+type negotiator struct {
+	io.ReadWriteCloser
+	legacy bool // peer speaks the newline-delimited protocol
+}
+
+func newNegotiator(pipe io.ReadWriteCloser) *negotiator {
+	return &negotiator{ReadWriteCloser: pipe}
+}
+
+// lead reads the first byte of a message from the peer and reports whether the
+// peer is speaking the legacy protocol.  The returned reader yields the full
+// message, including the byte that was already consumed.
+func (n *negotiator) lead() (r io.Reader, err error) {
+	var b [1]byte
+	if _, err = io.ReadFull(n, b[:]); err == nil {
+		n.legacy = b[0] != magic[0]
+		r = io.MultiReader(bytes.NewReader(b[:]), n.ReadWriteCloser)
+	}
+	return
+}
+
+func (n *negotiator) WriteHeaders(req request) error {
+	f := frame{kind: kindRequest}
+	f.add(fieldPath, []byte(req.path))
+	req.headers.encode(&f)
+	req.proto.encode(&f)
+	for _, c := range req.codecs {
+		f.add(fieldCodec, []byte(c))
+	}
+	return writeFrame(n, f)
+}
+
+// decodeLegacyAbort decodes the "<code>:<message>" answer of a legacy listener
+// into a *NegotiationError.  Anything else is reported as errLegacyPeer.
+func decodeLegacyAbort(line string) error {
+	i := strings.IndexByte(line, ':')
+	if i < 0 {
+		return errors.Wrapf(errLegacyPeer, "legacy listener answered %q", line)
+	}
+
+	code, err := strconv.Atoi(line[:i])
+	if err != nil || code < 100 || code > 999 {
+		return errors.Wrapf(errLegacyPeer, "legacy listener answered %q", line)
+	}
+	return &NegotiationError{Code: code, Message: line[i+1:]}
+}
+
+func (n *negotiator) Ack() (resp response, err error) {
+	var r io.Reader
+	if r, err = n.lead(); err != nil {
+		return
+	}
+
+	if n.legacy {
+		// Legacy listeners answer "\n" on success, or "<code>:<message>"
+		// followed by a close on failure.
+		var line string
+		if line, err = readLine(r); err == nil && line == "" {
+			return
+		} else if err == nil || err == io.EOF {
+			err = decodeLegacyAbort(line)
+		}
+		return
+	}
+
+	var f frame
+	if f, err = readFrame(r); err != nil {
+		return
+	}
+
+	switch f.kind {
+	case kindAccept:
+		if c, ok := f.get(fieldCodec); ok {
+			resp.codec = string(c)
+		}
+		resp.proto, err = decodeProto(f)
+	case kindAbort:
+		status, _ := f.getUint16(fieldStatus)
+		msg, _ := f.get(fieldMessage)
+		err = &NegotiationError{Code: int(status), Message: string(msg)}
+	case kindRedirect:
+		status, _ := f.getUint16(fieldStatus)
+		netloc, _ := f.get(fieldNetloc)
+		path, _ := f.get(fieldPath)
+		err = &Redirect{Code: int(status), Netloc: string(netloc), Path: string(path)}
+	default:
+		err = errors.Errorf("unexpected frame kind %d", f.kind)
+	}
+
+	return
+}
+
+func (n *negotiator) ReadHeaders() (req request, err error) {
+	var r io.Reader
+	if r, err = n.lead(); err != nil {
+		return
+	}
+
+	if n.legacy {
+		req.path, err = readLine(r)
+		return
+	}
+
+	var f frame
+	if f, err = readFrame(r); err != nil {
+		return
+	} else if f.kind != kindRequest {
+		err = errors.Errorf("unexpected frame kind %d", f.kind)
+		return
+	}
+
+	b, ok := f.get(fieldPath)
+	if !ok {
+		err = errors.New("missing path")
+		return
+	}
+	req.path = string(b)
+
+	req.headers = make(Headers)
+	if err = req.headers.decode(f); err == nil {
+		req.proto, err = decodeProto(f)
+		for _, c := range f.all(fieldCodec) {
+			req.codecs = append(req.codecs, string(c))
+		}
+	}
+
+	return
+}
+
+func (n *negotiator) Abort(status int, message string) error {
+	if n.legacy {
+		_, _ = io.WriteString(n, fmt.Sprintf("%d:%s", status, message)) // best-effort
+		return n.Close()
+	}
+
+	f := frame{kind: kindAbort}
+	f.addUint16(fieldStatus, uint16(status))
+	f.add(fieldMessage, []byte(message))
+	_ = writeFrame(n, f) // best-effort
+	return n.Close()
+}
+
+func (n *negotiator) Redirect(rd *Redirect) error {
+	if n.legacy {
+		return n.Abort(rd.code(), rd.Error())
+	}
+
+	f := frame{kind: kindRedirect}
+	f.addUint16(fieldStatus, uint16(rd.code()))
+	if rd.Netloc != "" {
+		f.add(fieldNetloc, []byte(rd.Netloc))
+	}
+	if rd.Path != "" {
+		f.add(fieldPath, []byte(rd.Path))
+	}
+	_ = writeFrame(n, f) // best-effort
+	return n.Close()
+}
+
+func (n *negotiator) Accept(resp response) error {
+	if n.legacy {
+		_, err := n.Write([]byte("\n"))
+		return err
+	}
+
+	f := frame{kind: kindAccept}
+	resp.proto.encode(&f)
+	if resp.codec != "" {
+		f.add(fieldCodec, []byte(resp.codec))
+	}
+	return writeFrame(n, f)
+}
@@ -0,0 +1,337 @@
+package quic
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// golden test vectors for version 1 of the negotiation protocol.  These must
+// never change; if they do, deployed peers will no longer understand us.
+var goldenFrames = []struct {
+	name string
+	f    frame
+	hex  string
+}{{
+	name: "Request",
+	f:    frame{kind: kindRequest, fields: []field{{fieldPath, []byte("/some/path")}}},
+	hex:  "00514d4e" + "01" + "01" + "0000000d" + "01000a2f736f6d652f70617468" + "0a",
+}, {
+	name: "RequestWithHeaders",
+	f: frame{kind: kindRequest, fields: []field{
+		{fieldPath, []byte("/p")},
+		{fieldHeader, []byte("\x00\x02id7")},
+	}},
+	hex: "00514d4e" + "01" + "01" + "0000000d" + "0100022f70" + "04000500026964" + "37" + "0a",
+}, {
+	name: "RequestWithProto",
+	f: frame{kind: kindRequest, fields: []field{
+		{fieldPath, []byte("/p")},
+		{fieldProto, []byte{0x00, 0x30, 0x00, 0x31}},
+	}},
+	hex: "00514d4e" + "01" + "01" + "0000000c" + "0100022f70" + "05000400300031" + "0a",
+}, {
+	name: "Accept",
+	f:    frame{kind: kindAccept},
+	hex:  "00514d4e" + "01" + "02" + "00000000" + "0a",
+}, {
+	name: "Abort",
+	f: frame{kind: kindAbort, fields: []field{
+		{fieldStatus, []byte{0x01, 0x94}},
+		{fieldMessage, []byte("not found")},
+	}},
+	hex: "00514d4e" + "01" + "03" + "00000011" + "0200020194" + "0300096e6f7420666f756e64" + "0a",
+}, {
+	name: "Redirect",
+	f: frame{kind: kindRedirect, fields: []field{
+		{fieldStatus, []byte{0x01, 0x33}},
+		{fieldNetloc, []byte("h:1")},
+		{fieldPath, []byte("/p")},
+	}},
+	hex: "00514d4e" + "01" + "04" + "00000010" + "0200020133" + "060003683a31" + "0100022f70" + "0a",
+}, {
+	name: "AcceptWithCodec",
+	f:    frame{kind: kindAccept, fields: []field{{fieldCodec, []byte("flate")}}},
+	hex:  "00514d4e" + "01" + "02" + "00000008" + "070005666c617465" + "0a",
+}}
+
+func TestFrame(t *testing.T) {
+	for _, golden := range goldenFrames {
+		t.Run(golden.name, func(t *testing.T) {
+			want, err := hex.DecodeString(golden.hex)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			t.Run("Marshal", func(t *testing.T) {
+				if b, err := golden.f.MarshalBinary(); err != nil {
+					t.Error(err)
+				} else if !bytes.Equal(b, want) {
+					t.Errorf("expected %x, got %x", want, b)
+				}
+			})
+
+			t.Run("Unmarshal", func(t *testing.T) {
+				var f frame
+				if err := f.UnmarshalBinary(want); err != nil {
+					t.Error(err)
+				} else if f.kind != golden.f.kind {
+					t.Errorf("expected kind %d, got %d", golden.f.kind, f.kind)
+				} else if len(f.fields) != len(golden.f.fields) {
+					t.Errorf("expected %d fields, got %d", len(golden.f.fields), len(f.fields))
+				} else {
+					for i, fd := range golden.f.fields {
+						if f.fields[i].tag != fd.tag || !bytes.Equal(f.fields[i].val, fd.val) {
+							t.Errorf("field %d: expected %d:%x, got %d:%x", i, fd.tag, fd.val, f.fields[i].tag, f.fields[i].val)
+						}
+					}
+				}
+			})
+
+			t.Run("Read", func(t *testing.T) {
+				// trailing bytes belong to the stream and must not be consumed
+				r := bytes.NewReader(append(want, "mangos"...))
+				if _, err := readFrame(r); err != nil {
+					t.Error(err)
+				} else if r.Len() != len("mangos") {
+					t.Errorf("readFrame consumed %d bytes past the trailer", len("mangos")-r.Len())
+				}
+			})
+		})
+	}
+
+	t.Run("Headers", func(t *testing.T) {
+		f := frame{kind: kindRequest}
+		f.add(fieldPath, []byte("/p"))
+		Headers{"id": "7"}.encode(&f)
+
+		if b, _ := f.MarshalBinary(); hex.EncodeToString(b) != goldenFrames[1].hex {
+			t.Errorf("expected %s, got %x", goldenFrames[1].hex, b)
+		}
+
+		f.add(fieldHeader, []byte{0x00, 0x09, 'k'})
+		if err := make(Headers).decode(f); err == nil {
+			t.Error("expected error for truncated header key")
+		}
+	})
+
+	t.Run("Proto", func(t *testing.T) {
+		f := frame{kind: kindRequest}
+		f.add(fieldPath, []byte("/p"))
+		(&spProto{number: 0x30, peer: 0x31}).encode(&f)
+
+		if b, _ := f.MarshalBinary(); hex.EncodeToString(b) != goldenFrames[2].hex {
+			t.Errorf("expected %s, got %x", goldenFrames[2].hex, b)
+		}
+
+		f = frame{kind: kindAccept}
+		f.add(fieldProto, []byte{0x00})
+		if _, err := decodeProto(f); err == nil {
+			t.Error("expected error for malformed protocol")
+		}
+	})
+
+	t.Run("UnknownField", func(t *testing.T) {
+		f := frame{kind: kindRequest}
+		f.add(0xff, []byte("from the future"))
+		f.add(fieldPath, []byte("/some/path"))
+
+		b, _ := f.MarshalBinary()
+		if g, err := readFrame(bytes.NewReader(b)); err != nil {
+			t.Error(err)
+		} else if p, ok := g.get(fieldPath); !ok || string(p) != "/some/path" {
+			t.Errorf("expected path /some/path, got %s", p)
+		}
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		for name, h := range map[string]string{
+			"BadVersion":     "00514d4e" + "02" + "01" + "00000000" + "0a",
+			"LengthTooLarge": "00514d4e" + "01" + "01" + "ffffffff" + "0a",
+			"Truncated":      "00514d4e" + "01" + "01" + "0000000d" + "01000a2f73",
+			"TruncatedField": "00514d4e" + "01" + "01" + "00000004" + "01000a2f" + "0a",
+			"MissingTrailer": "00514d4e" + "01" + "02" + "00000000" + "00",
+		} {
+			b, _ := hex.DecodeString(h)
+			if _, err := readFrame(bytes.NewReader(b)); err == nil {
+				t.Errorf("%s: expected error", name)
+			}
+		}
+	})
+
+	t.Run("FieldTooLarge", func(t *testing.T) {
+		f := frame{kind: kindRequest}
+		f.add(fieldPath, make([]byte, 1<<16))
+		if _, err := f.MarshalBinary(); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
+
+func TestNegotiator(t *testing.T) {
+	const path = "/some/path"
+	hdr := Headers{"client-id": "42", "tenant": "acme", "build": ""}
+	proto := &spProto{number: 0x30, peer: 0x31} // REQ/REP
+
+	buf := &bufCloser{Buffer: new(bytes.Buffer)}
+	n := newNegotiator(buf)
+
+	t.Run("PathNegotiation", func(t *testing.T) {
+		defer buf.Reset()
+
+		t.Run("WriteHeaders", func(t *testing.T) {
+			if err := n.WriteHeaders(request{path: path, headers: hdr, proto: proto}); err != nil {
+				t.Error(err)
+			}
+
+			if !bytes.HasPrefix(buf.Bytes(), magic[:]) {
+				t.Errorf("unexpected value in buffer: %v", buf.Bytes())
+			}
+		})
+
+		t.Run("Readheaders", func(t *testing.T) {
+			if req, err := n.ReadHeaders(); err != nil {
+				t.Error(err)
+			} else if req.path != path {
+				t.Errorf("expected path `%s`, got `%s`", path, req.path)
+			} else if !reflect.DeepEqual(req.headers, hdr) {
+				t.Errorf("expected headers %v, got %v", hdr, req.headers)
+			} else if req.proto == nil || *req.proto != *proto {
+				t.Errorf("expected protocol %v, got %v", proto, req.proto)
+			} else if n.legacy {
+				t.Error("peer wrongly detected as legacy")
+			}
+		})
+
+		t.Run("NewlineInPath", func(t *testing.T) {
+			if err := n.WriteHeaders(request{path: "/some\npath"}); err != nil {
+				t.Error(err)
+			} else if req, err := n.ReadHeaders(); err != nil {
+				t.Error(err)
+			} else if req.path != "/some\npath" {
+				t.Errorf("expected path `/some\\npath`, got `%s`", req.path)
+			}
+		})
+	})
+
+	t.Run("Accept/Ack", func(t *testing.T) {
+		defer buf.Reset()
+
+		t.Run("Accept", func(t *testing.T) {
+			if err := n.Accept(response{proto: proto}); err != nil {
+				t.Error(err)
+			}
+		})
+
+		t.Run("Ack", func(t *testing.T) {
+			if resp, err := n.Ack(); err != nil {
+				t.Error(err)
+			} else if resp.proto == nil || *resp.proto != *proto {
+				t.Errorf("expected protocol %v, got %v", proto, resp.proto)
+			}
+		})
+	})
+
+	t.Run("Abort/Ack", func(t *testing.T) {
+		defer buf.Reset()
+
+		t.Run("Abort", func(t *testing.T) {
+			if err := n.Abort(404, "not found"); err != nil {
+				t.Error(err)
+			} else if !buf.closed {
+				t.Error("stream not closed")
+			}
+		})
+
+		t.Run("Ack", func(t *testing.T) {
+			_, err := n.Ack()
+			if err == nil {
+				t.Error("no error reported for aborted transaction")
+			} else if ne, ok := err.(*NegotiationError); !ok {
+				t.Errorf("expected *NegotiationError, got %T", err)
+			} else if ne.Code != StatusNotFound || ne.Message != "not found" {
+				t.Errorf("unexpected negotiation error %s", ne)
+			}
+		})
+	})
+}
+
+func TestRedirect(t *testing.T) {
+	buf := &bufCloser{Buffer: new(bytes.Buffer)}
+	n := newNegotiator(buf)
+
+	if err := n.Redirect(&Redirect{Netloc: "h:1", Path: "/p"}); err != nil {
+		t.Error(err)
+	} else if !buf.closed {
+		t.Error("stream not closed")
+	}
+
+	_, err := n.Ack()
+	if rd, ok := err.(*Redirect); !ok {
+		t.Errorf("expected *Redirect, got %v", err)
+	} else if rd.Code != StatusTemporaryRedirect || rd.Netloc != "h:1" || rd.Path != "/p" {
+		t.Errorf("unexpected redirect %s", rd)
+	}
+}
+
+func TestLegacyNegotiator(t *testing.T) {
+	const path = "/some/path"
+
+	t.Run("ListenSide", func(t *testing.T) {
+		buf := &bufCloser{Buffer: bytes.NewBufferString(path + "\n")}
+		n := newNegotiator(buf)
+
+		if req, err := n.ReadHeaders(); err != nil {
+			t.Error(err)
+		} else if req.path != path {
+			t.Errorf("expected path `%s`, got `%s`", path, req.path)
+		} else if !n.legacy {
+			t.Error("legacy peer not detected")
+		}
+
+		t.Run("Accept", func(t *testing.T) {
+			defer buf.Reset()
+
+			if err := n.Accept(response{}); err != nil {
+				t.Error(err)
+			} else if buf.String() != "\n" {
+				t.Errorf("expected legacy accept, got `%s`", buf.String())
+			}
+		})
+
+		t.Run("Abort", func(t *testing.T) {
+			defer buf.Reset()
+
+			if err := n.Abort(404, "not found"); err != nil {
+				t.Error(err)
+			} else if buf.String() != "404:not found" {
+				t.Errorf("expected `404:not found`, got `%s`", buf.String())
+			}
+		})
+	})
+
+	t.Run("DialSide", func(t *testing.T) {
+		buf := &bufCloser{Buffer: bytes.NewBufferString("404:\x00QMN")}
+		n := newNegotiator(buf)
+
+		if _, err := n.Ack(); err == nil {
+			t.Error("no error reported for aborted transaction")
+		} else if ne, ok := errors.Cause(err).(*NegotiationError); !ok {
+			t.Errorf("expected *NegotiationError, got %v", err)
+		} else if ne.Code != StatusNotFound || ne.Message != "\x00QMN" {
+			t.Errorf("unexpected negotiation error %s", ne)
+		}
+
+		t.Run("Garbled", func(t *testing.T) {
+			n := newNegotiator(&bufCloser{Buffer: bytes.NewBufferString("oops")})
+			if _, err := n.Ack(); !strings.Contains(fmt.Sprint(err), errLegacyPeer.Error()) {
+				t.Errorf("expected legacy peer error, got %v", err)
+			}
+		})
+	})
+}
@@ -1,14 +1,15 @@
 package quic
 
 import (
-	"bufio"
-	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
-	"io"
 	"net"
 	"net/url"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/SentimensRG/ctx"
 	radix "github.com/armon/go-radix"
@@ -16,8 +17,6 @@ import (
 	"github.com/pkg/errors"
 )
 
-var mux = newMux()
-
 type netlocator interface {
 	Netloc() string
 }
@@ -27,28 +26,102 @@ type netloc struct{ *url.URL }
 func (n netloc) Netloc() string { return n.Host }
 
 type sessionDropper interface {
-	DelSession(net.Addr)
+	DelSession(*refcntSession)
+	Emit(SessionEvent)
 }
 
 type dialMuxer interface {
 	sync.Locker
-	GetSession(netlocator) (*refcntSession, bool)
-	AddSession(net.Addr, *refcntSession)
+	GetSession(key string) (*refcntSession, bool)
+	AddSession(key string, sess *refcntSession)
+	GetInbound(key string) (*refcntSession, bool)
+	ReserveSlot(key string)
+	ReleaseSlot(key string)
+	Dialing(key string) <-chan struct{}
+	LoadConn(addr string) (*sharedConn, error)
+	ReleaseConn(c *sharedConn) error
+	DialAddr(c context.Context, addr string, tc *tls.Config, qc *quic.Config) (quic.Session, error)
+	addrResolver
 	sessionDropper
 }
 
+type addrResolver interface {
+	ResolveAddr(addr string) (net.Addr, error)
+}
+
+// packetNetwork opens and addresses the packet sockets that sessions run over
+type packetNetwork interface {
+	addrResolver
+	ListenPacket(addr string) (net.PacketConn, error)
+	DialAddr(c context.Context, addr string, tc *tls.Config, qc *quic.Config) (quic.Session, error)
+}
+
+// udpNetwork is the packetNetwork of quic:// transports
+type udpNetwork struct{}
+
+func (udpNetwork) ResolveAddr(addr string) (net.Addr, error) { return net.ResolveUDPAddr("udp", addr) }
+
+func (udpNetwork) ListenPacket(addr string) (net.PacketConn, error) {
+	return net.ListenPacket("udp", addr)
+}
+
+func (udpNetwork) DialAddr(c context.Context, addr string, tc *tls.Config, qc *quic.Config) (quic.Session, error) {
+	return quic.DialAddrContext(c, addr, tc, qc)
+}
+
+// sessionKey identifies the session dialed to netloc n by the address of the
+// peer, as resolved by r, the TLS server name set in tc, if any, and the local
+// address it is dialed from, if any.  Dialing a host by name or by address thus
+// yields the same session, whatever the path.
+func sessionKey(r addrResolver, n netlocator, tc *tls.Config, local string) (string, error) {
+	a, err := r.ResolveAddr(n.Netloc())
+	if err != nil {
+		return "", errors.Wrap(err, "resolve")
+	}
+
+	key := a.String()
+	if tc != nil && tc.ServerName != "" {
+		key += "/" + tc.ServerName
+	}
+
+	if local != "" {
+		la, err := r.ResolveAddr(local)
+		if err != nil {
+			return "", errors.Wrap(err, "resolve local")
+		}
+		key += "@" + la.String()
+	}
+	return key, nil
+}
+
 type multiplexer struct {
 	sync.Mutex
 	listeners map[string]*refcntListener
-	sessions  map[string]*refcntSession
+	sessions  map[string]*refcntSession // dialed sessions, see sessionKey
+	inbound   map[string]*refcntSession // accepted sessions, by remote address
+	dialing   map[string]chan struct{}  // session keys being dialed, see ReserveSlot
+	reverse   map[*reverseSession]struct{}
+	fallbacks map[string]FallbackFunc
+	hidden    map[string]int // number of listeners that disabled discovery
 	routes    *router
+	events    observers
+	reaper    chan struct{}          // closed to stop the idle session reaper
+	conns     map[string]*sharedConn // sockets shared by listeners and dialers
+	network   packetNetwork
 }
 
 func newMux() *multiplexer {
 	return &multiplexer{
 		listeners: make(map[string]*refcntListener),
 		sessions:  make(map[string]*refcntSession),
+		inbound:   make(map[string]*refcntSession),
+		dialing:   make(map[string]chan struct{}),
+		reverse:   make(map[*reverseSession]struct{}),
+		fallbacks: make(map[string]FallbackFunc),
+		hidden:    make(map[string]int),
 		routes:    newRouter(),
+		conns:     make(map[string]*sharedConn),
+		network:   udpNetwork{},
 	}
 }
 
@@ -67,23 +140,286 @@ func (m *multiplexer) DelListener(n netlocator) {
 	m.Unlock()
 }
 
-func (m *multiplexer) GetSession(n netlocator) (s *refcntSession, ok bool) {
-	s, ok = m.sessions[n.Netloc()]
+func (m *multiplexer) GetSession(key string) (s *refcntSession, ok bool) {
+	s, ok = m.sessions[key]
+	return
+}
+
+func (m *multiplexer) AddSession(key string, sess *refcntSession) {
+	m.sessions[key] = sess
+}
+
+// GetInbound returns the session accepted from the peer at the remote address
+// key.  Accepted sessions are kept apart from dialed ones, since a peer we both
+// dialed and were dialed by, e.g. when punching through a NAT, has one of each
+// under the same address.  The caller must hold the lock.
+func (m *multiplexer) GetInbound(key string) (s *refcntSession, ok bool) {
+	s, ok = m.inbound[key]
 	return
 }
 
-func (m *multiplexer) AddSession(a net.Addr, sess *refcntSession) {
-	m.sessions[a.String()] = sess
+// AddInbound stores a session accepted from the peer at the remote address
+// key.  The caller must hold the lock.
+func (m *multiplexer) AddInbound(key string, sess *refcntSession) {
+	m.inbound[key] = sess
 }
 
-func (m *multiplexer) DelSession(a net.Addr) {
+// AddReverse tracks the session of a reverse listener, so that Close stops it.
+// The caller must hold the lock.
+func (m *multiplexer) AddReverse(rs *reverseSession) { m.reverse[rs] = struct{}{} }
+
+// DelReverse stops tracking rs.  The caller must hold the lock.
+func (m *multiplexer) DelReverse(rs *reverseSession) { delete(m.reverse, rs) }
+
+// ReserveSlot marks key as being dialed, so that other dialers wait for its
+// session rather than dial their own while the handshake runs without the lock.
+// The caller must hold the lock.
+func (m *multiplexer) ReserveSlot(key string) {
+	m.dialing[key] = make(chan struct{})
+}
+
+// ReleaseSlot ends the reservation of key, whether or not a session was stored
+// under it.  The caller must hold the lock.
+func (m *multiplexer) ReleaseSlot(key string) {
+	if ch, ok := m.dialing[key]; ok {
+		close(ch)
+		delete(m.dialing, key)
+	}
+}
+
+// Dialing returns a channel closed once the reservation of key ends, or nil if
+// key is not being dialed.  The caller must hold the lock.
+func (m *multiplexer) Dialing(key string) <-chan struct{} {
+	if ch, ok := m.dialing[key]; ok {
+		return ch
+	}
+	return nil
+}
+
+// DelSession removes sess from the multiplexer, unless its key has already
+// been reused by another session
+func (m *multiplexer) DelSession(sess *refcntSession) {
 	m.Lock()
-	delete(m.sessions, a.String())
+	ss := m.sessions
+	if sess.inbound {
+		ss = m.inbound
+	}
+
+	if ss[sess.key] == sess {
+		delete(ss, sess.key)
+	}
 	m.Unlock()
 }
 
-func (m *multiplexer) RegisterPath(path string, ch chan<- net.Conn) (err error) {
-	if !m.routes.Add(path, ch) {
+// LoadConn returns the shared UDP socket bound to addr, opening it if needed,
+// with its reference count incremented on behalf of the caller.  The caller
+// must hold the lock.
+func (m *multiplexer) LoadConn(addr string) (*sharedConn, error) {
+	a, err := m.ResolveAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, ok := m.conns[a.String()]
+	if !ok {
+		pc, err := m.network.ListenPacket(a.String())
+		if err != nil {
+			return nil, err
+		}
+
+		c = &sharedConn{key: a.String(), PacketConn: pc}
+		m.conns[c.key] = c
+	}
+
+	c.refcnt++
+	return c, nil
+}
+
+// ResolveAddr resolves addr on the transport's network
+func (m *multiplexer) ResolveAddr(addr string) (net.Addr, error) { return m.network.ResolveAddr(addr) }
+
+// DialAddr dials a session to addr on the transport's network, from a socket of
+// its own
+func (m *multiplexer) DialAddr(c context.Context, addr string, tc *tls.Config, qc *quic.Config) (quic.Session, error) {
+	return m.network.DialAddr(c, addr, tc, qc)
+}
+
+// ReleaseConn drops a reference to c, and closes it once the last is dropped.
+// The caller must hold the lock.
+func (m *multiplexer) ReleaseConn(c *sharedConn) error {
+	if c.refcnt--; c.refcnt > 0 {
+		return nil
+	}
+
+	if m.conns[c.key] == c {
+		delete(m.conns, c.key)
+	}
+	return c.Close()
+}
+
+// Emit notifies the transport's subscribers of a session event
+func (m *multiplexer) Emit(ev SessionEvent) { m.events.emit(ev) }
+
+// SetPipeIdleTimeout starts a reaper that closes the inbound sessions on which
+// no stream has been open for d, replacing any previous one.  A zero duration
+// stops the reaper.
+func (m *multiplexer) SetPipeIdleTimeout(d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.stopReaper(); d > 0 {
+		m.reaper = make(chan struct{})
+		go m.reap(d, m.reaper)
+	}
+}
+
+// stopReaper stops the idle session reaper, if any.  The caller must hold the
+// lock.
+func (m *multiplexer) stopReaper() {
+	if m.reaper != nil {
+		close(m.reaper)
+		m.reaper = nil
+	}
+}
+
+// reap closes sessions idle for d until stop is closed.  Sessions are checked
+// every d/2, and so live up to 1.5d without a stream.
+func (m *multiplexer) reap(d time.Duration, stop <-chan struct{}) {
+	interval := d / 2
+	if interval == 0 {
+		interval = d
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case now := <-t.C:
+			m.reapIdle(now, d)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// reapIdle closes the inbound sessions that have been idle for d as of now.
+// Dialed sessions need no reaping, as they close when their last stream does.
+func (m *multiplexer) reapIdle(now time.Time, d time.Duration) {
+	var idle []*refcntSession
+
+	m.Lock()
+	for key, s := range m.inbound {
+		if s.idleFor(now) >= d {
+			idle = append(idle, s)
+			delete(m.inbound, key)
+		}
+	}
+	m.Unlock()
+
+	for _, s := range idle {
+		s.closing(ErrSessionIdle)
+		_ = s.CloseWithError(ErrorCodeGoingAway, ErrSessionIdle)
+	}
+}
+
+func (m *multiplexer) SetFallback(n netlocator, fn FallbackFunc) (err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.fallbacks[n.Netloc()]; ok {
+		err = errors.Errorf("fallback already registered for %s", n.Netloc())
+	} else {
+		m.fallbacks[n.Netloc()] = fn
+	}
+	return
+}
+
+func (m *multiplexer) GetFallback(n netlocator) (fn FallbackFunc, ok bool) {
+	m.Lock()
+	fn, ok = m.fallbacks[n.Netloc()]
+	m.Unlock()
+	return
+}
+
+func (m *multiplexer) DelFallback(n netlocator) {
+	m.Lock()
+	delete(m.fallbacks, n.Netloc())
+	m.Unlock()
+}
+
+// Close closes every listener and session, and unregisters every route
+func (m *multiplexer) Close() (err error) {
+	m.Lock()
+	ls, ss, is, rs := m.listeners, m.sessions, m.inbound, m.reverse
+	m.listeners = make(map[string]*refcntListener)
+	m.sessions = make(map[string]*refcntSession)
+	m.inbound = make(map[string]*refcntSession)
+	m.reverse = make(map[*reverseSession]struct{})
+	m.fallbacks = make(map[string]FallbackFunc)
+	m.hidden = make(map[string]int)
+	m.routes = newRouter()
+	m.stopReaper()
+	m.Unlock()
+
+	// Reverse listeners must not redial the sessions we are about to close
+	for r := range rs {
+		r.stop()
+	}
+
+	// Go away from the sessions before closing the listeners, which would
+	// close the inbound ones without a word to their peers.
+	for _, s := range ss {
+		if e := s.goAway(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	for _, s := range is {
+		if e := s.goAway(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	for _, l := range ls {
+		if e := l.shutdown(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	for r := range rs {
+		if e := r.release(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return
+}
+
+// HideRoutes disables route discovery on netloc n until a matching call to
+// ShowRoutes.
+func (m *multiplexer) HideRoutes(n netlocator) {
+	m.Lock()
+	m.hidden[n.Netloc()]++
+	m.Unlock()
+}
+
+func (m *multiplexer) ShowRoutes(n netlocator) {
+	m.Lock()
+	if m.hidden[n.Netloc()]--; m.hidden[n.Netloc()] <= 0 {
+		delete(m.hidden, n.Netloc())
+	}
+	m.Unlock()
+}
+
+func (m *multiplexer) discoverable(n netlocator) bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.hidden[n.Netloc()] == 0
+}
+
+func (m *multiplexer) RegisterPath(path string, rt *route) (err error) {
+	if !m.routes.Add(path, rt) {
 		err = errors.Errorf("route already registered for %s", path)
 	}
 	return
@@ -91,144 +427,622 @@ func (m *multiplexer) RegisterPath(path string, ch chan<- net.Conn) (err error)
 
 func (m *multiplexer) UnregisterPath(path string) { m.routes.Del(path) }
 
-func (m *multiplexer) Serve(sess quic.Session) {
-	for range ctx.Tick(sess.Context()) {
+// Serve routes the streams of a session accepted by the listener at netloc n.
+// It returns once the session is closed.
+func (m *multiplexer) Serve(n netlocator, sess quic.Session) {
+	for {
 		stream, err := sess.AcceptStream()
 		if err != nil {
-			continue
+			return // AcceptStream only fails once the session is closed
 		}
 
-		go m.routeStream(sess, stream)
+		go m.routeStream(n, sess, stream)
 	}
 }
 
-func (m *multiplexer) routeStream(sess quic.Session, stream quic.Stream) {
-	var n listenNegotiator = newNegotiator(stream)
+func (m *multiplexer) routeStream(n netlocator, sess quic.Session, stream quic.Stream) {
+	var neg listenNegotiator = newNegotiator(stream)
 
-	path, err := n.ReadHeaders()
-	if err != nil {
-		n.Abort(400, err.Error())
+	// The route, and so its timeout, is only known once the headers are read
+	start := time.Now()
+	if timeout := m.routes.NegotiationTimeout(n.Netloc()); timeout > 0 {
+		_ = stream.SetDeadline(start.Add(timeout))
+	}
+
+	req, err := neg.ReadHeaders()
+	if isTimeout(err) {
+		_ = stream.SetWriteDeadline(time.Time{}) // let the abort through
+		neg.Abort(StatusTimeout, "timed out reading headers")
+		return
+	} else if err != nil {
+		neg.Abort(StatusBadRequest, err.Error())
 		return
-	} else if ch, ok := m.routes.Get(path); !ok {
-		n.Abort(404, path)
+	}
+
+	if req.path == DiscoveryPath && m.discoverable(n) {
+		m.serveRoutes(n, neg, stream)
 		return
-	} else if err = n.Accept(); err != nil {
-		_ = stream.Close()
+	}
+
+	rt, match, ok := m.routes.Match(req.path)
+	if !ok {
+		if rt, match, err = m.fallback(n, req); err != nil {
+			if rd, ok := errors.Cause(err).(*Redirect); ok {
+				neg.Redirect(rd)
+			} else {
+				ne := asNegotiationError(err, StatusNotFound)
+				neg.Abort(ne.Code, ne.Message)
+			}
+			return
+		}
+	}
+
+	if rt.negotiation > 0 {
+		_ = stream.SetDeadline(start.Add(rt.negotiation))
 	} else {
-		ch <- &conn{Session: sess, Stream: stream}
+		_ = stream.SetDeadline(time.Time{})
+	}
+
+	c := &conn{Session: sess, Stream: stream, headers: req.headers, match: match}
+
+	// Both sides announced their protocol, so we can reject a mismatch here
+	// and skip the SP header exchange once the stream is accepted.
+	if req.proto != nil && rt.proto != nil {
+		if !rt.proto.compatible(*req.proto) {
+			neg.Abort(StatusProtocolMismatch, fmt.Sprintf("protocol %d cannot talk to %d",
+				req.proto.number, rt.proto.number))
+			return
+		}
+		c.peer = req.proto
+	}
+
+	rt.enqueue(pendingConn{
+		conn: c,
+		neg:  neg,
+		resp: response{proto: rt.proto, codec: pickCodec(req.codecs, rt.codecs)},
+	})
+}
+
+// track counts c as active until its stream is closed
+func (rt *route) track(c net.Conn) {
+	ctx.Defer(c.(*conn).Stream.Context(), rt.hold())
+}
+
+// hold counts a stream as active until release is called
+func (rt *route) hold() (release func()) {
+	rt.activeMu.Lock()
+	defer rt.activeMu.Unlock()
+
+	if rt.active++; rt.active == 1 {
+		rt.idle = make(chan struct{})
+	}
+
+	return func() {
+		rt.activeMu.Lock()
+		defer rt.activeMu.Unlock()
+
+		if rt.active--; rt.active == 0 {
+			close(rt.idle)
+		}
 	}
 }
 
-type (
-	listenNegotiator interface {
-		ReadHeaders() (string, error)
-		Abort(int, string) error
-		Accept() error
+// drain rejects the streams in the backlog, and waits up to timeout for the
+// streams accepted on the route to be closed.  The route must be closed.
+func (rt *route) drain(timeout time.Duration) {
+	rt.flush()
+	defer rt.flush() // catch streams that were routed while we waited
+
+	rt.activeMu.Lock()
+	idle, busy := rt.idle, rt.active > 0
+	rt.activeMu.Unlock()
+
+	if busy {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+
+		select {
+		case <-idle:
+		case <-t.C:
+		}
 	}
+}
 
-	dialNegotiator interface {
-		WriteHeaders(string) error
-		Ack() error
+func (rt *route) flush() {
+	for {
+		select {
+		case p := <-rt.ch:
+			p.neg.Abort(StatusUnavailable, "listener going away")
+		default:
+			return
+		}
 	}
-)
+}
 
-type negotiator struct {
-	io.ReadWriteCloser
+// pendingConn is a routed stream awaiting a call to Accept on its route.  The
+// listener's answer is withheld until then, so that a dialer whose stream is
+// dropped from the backlog can be told so.
+type pendingConn struct {
+	*conn
+	neg  listenNegotiator
+	resp response
 }
 
-func newNegotiator(pipe io.ReadWriteCloser) *negotiator {
-	return &negotiator{ReadWriteCloser: pipe}
+// accept answers the dialer and returns the stream, ready for use
+func (p pendingConn) accept() (net.Conn, error) {
+	if err := p.neg.Accept(p.resp); err != nil {
+		_ = p.Stream.Close()
+		return nil, err
+	}
+
+	_ = p.Stream.SetDeadline(time.Time{})
+	p.compress(p.resp.codec)
+	if sess, ok := p.Session.(*refcntSession); ok {
+		sess.track(p.match.path, p.Stream)
+	}
+	return p.conn, nil
 }
 
-func (n negotiator) WriteHeaders(path string) (err error) {
-	buf := bytes.NewBufferString(path + "\n")
-	_, err = io.Copy(n, buf)
-	return
+func (p pendingConn) reject(msg string) { p.neg.Abort(StatusBusy, msg) }
+
+// serveRoutes answers a discovery request with the list of routes registered
+// on n.  A list too large for a single frame is refused with StatusUnavailable.
+func (m *multiplexer) serveRoutes(n netlocator, neg listenNegotiator, stream quic.Stream) {
+	defer stream.Close()
+
+	f := frame{kind: kindRoutes}
+	for _, ri := range m.routes.List(n.Netloc()) {
+		ri.encode(&f)
+	}
+
+	b, err := f.MarshalBinary()
+	if err != nil {
+		neg.Abort(StatusUnavailable, "route list exceeds frame size")
+		return
+	}
+
+	if err = neg.Accept(response{}); err == nil {
+		_, _ = stream.Write(b)
+	}
 }
 
-func (n negotiator) Ack() (err error) {
-	scanner := bufio.NewScanner(n)
+// FallbackFunc decides the fate of a stream whose path matches no route.  It
+// returns the path of the route that should serve the stream instead, or an
+// error with which to abort the negotiation.  A *NegotiationError is relayed to
+// the dialer as is, a *Redirect sends the dialer elsewhere, and any other error
+// results in StatusNotFound.
+type FallbackFunc func(path string, h Headers) (string, error)
 
-	if !scanner.Scan() {
-		err = io.EOF
-	} else if err = scanner.Err(); err == nil {
-		if data := scanner.Text(); data != "" {
-			err = errors.New(data)
+// FallbackTo returns a FallbackFunc that hands unmatched streams to the socket
+// listening on path, making it a catch-all for its netloc.
+func FallbackTo(path string) FallbackFunc {
+	return func(string, Headers) (string, error) { return path, nil }
+}
+
+// RedirectTo returns a FallbackFunc that redirects unmatched streams to the
+// same path on another netloc, e.g. after a service has moved to a new host.
+func RedirectTo(netloc string) FallbackFunc {
+	return func(string, Headers) (string, error) {
+		return "", &Redirect{Code: StatusMovedPermanently, Netloc: netloc}
+	}
+}
+
+// fallback routes a request that matched no route, using the fallback
+// registered for netloc n, if any.
+func (m *multiplexer) fallback(n netlocator, req request) (rt *route, match routeMatch, err error) {
+	fn, ok := m.GetFallback(n)
+	if !ok {
+		err = &NegotiationError{Code: StatusNotFound, Message: req.path}
+		return
+	}
+
+	var path string
+	if path, err = fn(req.path, req.headers); err == nil {
+		if rt, match, ok = m.routes.Match(path); !ok {
+			err = &NegotiationError{Code: StatusNotFound, Message: req.path}
 		}
+		match.path = req.path
 	}
 
 	return
 }
 
-func (n negotiator) ReadHeaders() (path string, err error) {
-	scanner := bufio.NewScanner(n)
+// route is the endpoint for streams negotiated on a given path
+type route struct {
+	pat    pattern
+	ch     chan pendingConn // backlog of streams awaiting Accept
+	done   chan struct{}    // closed when the route's listener is closed
+	policy BacklogPolicy    // applied when the backlog is full
+	proto  *spProto         // nil if the listening socket's protocol is unknown
+	codecs []string         // compression codecs accepted on the route
 
-	if !scanner.Scan() {
-		err = io.EOF
-	} else if err = scanner.Err(); err == nil {
-		path = scanner.Text()
+	activeMu sync.Mutex
+	active   int           // number of accepted streams still open
+	idle     chan struct{} // closed once active drops back to zero
+
+	timeout     time.Duration // bounds each call to Accept, see OptionAcceptTimeout
+	negotiation time.Duration // bounds the negotiation of each stream, see OptionNegotiationTimeout
+	netlocs     []string      // hosts the route is listed on by discovery
+}
+
+// servedOn reports whether the route's listener listens on netloc
+func (rt *route) servedOn(netloc string) bool {
+	for _, n := range rt.netlocs {
+		if n == netloc {
+			return true
+		}
 	}
+	return false
+}
 
-	return
+// enqueue adds p to the route's backlog.  If the backlog is full, either p or
+// the oldest stream in the backlog is rejected with StatusBusy, depending on
+// the route's policy.
+func (rt *route) enqueue(p pendingConn) {
+	select {
+	case <-rt.done:
+		p.neg.Abort(StatusUnavailable, "listener going away")
+		return
+	default:
+	}
+
+	for {
+		select {
+		case rt.ch <- p:
+			return
+		default:
+		}
+
+		if rt.policy == BacklogReject {
+			p.reject("accept backlog full")
+			return
+		}
+
+		select {
+		case old := <-rt.ch:
+			old.reject("dropped from accept backlog")
+		default:
+		}
+	}
 }
 
-func (n negotiator) Abort(status int, message string) error {
-	buf := bytes.NewBufferString(fmt.Sprintf("%d:%s", status, message))
-	_, _ = io.Copy(n, buf) // best-effort
-	return n.Close()
+// pattern is a parsed route path.  Segments beginning with ':' are parameters,
+// which match any single path segment.  A trailing slash denotes a subtree
+// route, which matches the path itself and every path beneath it; e.g.
+// "/rooms/" matches "/rooms" and "/rooms/42".  The root is never a subtree.
+type pattern struct {
+	raw     string
+	segs    []string
+	subtree bool
 }
 
-func (n negotiator) Accept() (err error) {
-	_, err = n.Write([]byte("\n"))
-	return
+func parsePattern(path string) pattern {
+	p := pattern{raw: path, segs: splitPath(path)}
+	p.subtree = len(p.segs) > 0 && strings.HasSuffix(path, "/")
+	return p
+}
+
+func splitPath(path string) []string {
+	if path = strings.Trim(path, "/"); path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func isParam(seg string) bool { return strings.HasPrefix(seg, ":") }
+
+// key returns the literal head of the pattern, i.e. everything up to the first
+// parameter.  Patterns are indexed by it in the radix tree.
+func (p pattern) key() string {
+	var head []string
+	for _, seg := range p.segs {
+		if isParam(seg) {
+			break
+		}
+		head = append(head, seg)
+	}
+	return "/" + strings.Join(head, "/")
+}
+
+func (p pattern) match(segs []string) (m routeMatch, ok bool) {
+	if len(segs) < len(p.segs) || (!p.subtree && len(segs) != len(p.segs)) {
+		return
+	}
+
+	m.params = make(map[string]string)
+	for i, seg := range p.segs {
+		if isParam(seg) {
+			m.params[seg[1:]] = segs[i]
+		} else if seg != segs[i] {
+			return
+		}
+	}
+
+	m.pattern = p.raw
+	m.remainder = strings.Join(segs[len(p.segs):], "/")
+	return m, true
+}
+
+// beats reports whether p is more specific than q, assuming both match the same
+// path.  Segments are compared from left to right, and the first literal
+// segment facing a parameter wins.  Failing that, the longer pattern wins, and
+// failing that, a route that is not a subtree wins.  This amounts to a
+// longest-prefix match in which literals take precedence over parameters.
+func (p pattern) beats(q pattern) bool {
+	for i := 0; i < len(p.segs) && i < len(q.segs); i++ {
+		if pp, qp := isParam(p.segs[i]), isParam(q.segs[i]); pp != qp {
+			return qp
+		}
+	}
+
+	if len(p.segs) != len(q.segs) {
+		return len(p.segs) > len(q.segs)
+	}
+
+	return !p.subtree && q.subtree
 }
 
+// equivalent reports whether p and q match exactly the same paths
+func (p pattern) equivalent(q pattern) bool {
+	if len(p.segs) != len(q.segs) || p.subtree != q.subtree {
+		return false
+	}
+
+	for i, seg := range p.segs {
+		if isParam(seg) != isParam(q.segs[i]) || (!isParam(seg) && seg != q.segs[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// routeMatch describes how a negotiated path was routed
+type routeMatch struct {
+	path      string            // path requested by the dialer
+	pattern   string            // path of the matching route
+	params    map[string]string // values of the pattern's parameters
+	remainder string            // part of the path beneath a subtree route
+}
+
+// router maps paths to routes.  Patterns are stored in a radix tree under their
+// literal head, so the candidates for a path are found by walking the tree
+// along it.
 type router struct {
 	sync.RWMutex
-	routes *radix.Tree
+	routes *radix.Tree // literal head -> []*route
 }
 
 func newRouter() *router { return &router{routes: radix.New()} }
 
-func (r *router) Get(path string) (ch chan<- net.Conn, ok bool) {
+// Get returns the route registered under the exact pattern given by path
+func (r *router) Get(path string) (rt *route, ok bool) {
 	r.RLock()
 	defer r.RUnlock()
 
-	var v interface{}
-	if v, ok = r.routes.Get(path); ok {
-		ch = v.(chan<- net.Conn)
+	v, found := r.routes.Get(parsePattern(path).key())
+	if found {
+		for _, rt = range v.([]*route) {
+			if ok = rt.pat.raw == path; ok {
+				return
+			}
+		}
 	}
 
+	return nil, false
+}
+
+// Match returns the most specific route matching path
+func (r *router) Match(path string) (rt *route, m routeMatch, ok bool) {
+	segs := splitPath(path)
+
+	r.RLock()
+	defer r.RUnlock()
+
+	r.routes.WalkPath(path, func(_ string, v interface{}) bool {
+		for _, cand := range v.([]*route) {
+			if cm, hit := cand.pat.match(segs); hit && (rt == nil || cand.pat.beats(rt.pat)) {
+				rt, m = cand, cm
+			}
+		}
+		return false
+	})
+
+	m.path = path
+	ok = rt != nil
 	return
 }
 
-func (r *router) Add(path string, ch chan<- net.Conn) (ok bool) {
+func (r *router) Add(path string, rt *route) (ok bool) {
+	rt.pat = parsePattern(path)
+	key := rt.pat.key()
+
 	r.Lock()
-	if _, ok = r.routes.Get(path); !ok {
-		r.routes.Insert(path, ch)
+	defer r.Unlock()
+
+	var bucket []*route
+	if v, found := r.routes.Get(key); found {
+		bucket = v.([]*route)
 	}
-	r.Unlock()
-	ok = !ok // turn "value not found" into "value successfully inserted"
-	return
+
+	for _, other := range bucket {
+		if other.pat.equivalent(rt.pat) {
+			return false
+		}
+	}
+
+	r.routes.Insert(key, append(bucket, rt))
+	return true
 }
 
 func (r *router) Del(path string) {
+	key := parsePattern(path).key()
+
 	r.Lock()
-	r.routes.Delete(path)
-	r.Unlock()
+	defer r.Unlock()
+
+	v, found := r.routes.Get(key)
+	if !found {
+		return
+	}
+
+	var bucket []*route
+	for _, rt := range v.([]*route) {
+		if rt.pat.raw != path {
+			bucket = append(bucket, rt)
+		}
+	}
+
+	if len(bucket) == 0 {
+		r.routes.Delete(key)
+	} else {
+		r.routes.Insert(key, bucket)
+	}
+}
+
+// NegotiationTimeout bounds the reading of headers from a stream accepted at
+// netloc, before its route is known.  It is the longest negotiation timeout of
+// the routes served there, or zero if any of them is unbounded.
+func (r *router) NegotiationTimeout(netloc string) (timeout time.Duration) {
+	served, unbounded := false, false
+
+	r.RLock()
+	defer r.RUnlock()
+
+	r.routes.Walk(func(_ string, v interface{}) bool {
+		for _, rt := range v.([]*route) {
+			if !rt.servedOn(netloc) {
+				continue
+			}
+
+			served = true
+			if unbounded = rt.negotiation <= 0; unbounded {
+				return true
+			} else if rt.negotiation > timeout {
+				timeout = rt.negotiation
+			}
+		}
+		return false
+	})
+
+	switch {
+	case unbounded:
+		return 0
+	case !served:
+		return defaultNegotiationTimeout
+	}
+	return
+}
+
+// sharedConn is a UDP socket owned by the transport.  It is shared by the
+// listener bound to its address and the sessions dialed from it, and is
+// reference-counted under the multiplexer's lock.
+type sharedConn struct {
+	key    string
+	refcnt int
+	net.PacketConn
 }
 
 type refcntSession struct {
-	gc     func()
-	refcnt int32
+	gc      func()
+	emit    func(SessionEvent)
+	refcnt  int32
+	served  int32 // set once a goroutine serves the streams opened by the peer
+	key     string
+	inbound bool
+	closed  sync.Once
+
+	pathsMu sync.Mutex
+	paths   map[string]int // number of streams open on each path
+	addr    string         // remote address, as of the last stream
+	idle    time.Time      // when the last stream was closed
 	quic.Session
 }
 
-func newRefCntSession(sess quic.Session, d sessionDropper) *refcntSession {
-	return &refcntSession{
+func newRefCntSession(sess quic.Session, key string, d sessionDropper) *refcntSession {
+	r := &refcntSession{
 		Session: sess,
-		gc:      func() { d.DelSession(sess.RemoteAddr()) },
+		key:     key,
+		emit:    d.Emit,
+		paths:   make(map[string]int),
+		addr:    sess.RemoteAddr().String(),
+		idle:    time.Now(),
 	}
+	r.gc = func() { d.DelSession(r) }
+	return r
+}
+
+// open announces the session to the transport's subscribers, and watches for
+// it to be closed by the peer
+func (r *refcntSession) open() {
+	r.emit(r.event(SessionOpened, nil))
+	ctx.Defer(r.Context(), func() { r.closing(r.closeErr()) })
+}
+
+// closeErr returns the reason the session was closed, which quic-go gives to
+// calls to AcceptStream once the session's context has expired
+func (r *refcntSession) closeErr() error {
+	stream, err := r.AcceptStream()
+	switch {
+	case isGoingAway(err):
+		return ErrGoingAway
+	case err != nil:
+		return err
+	}
+
+	_ = stream.Close()
+	return ErrSessionClosed
+}
+
+// closing announces that the session is closed for the given reason.  Only the
+// first call has any effect.
+func (r *refcntSession) closing(reason error) {
+	r.closed.Do(func() { r.emit(r.event(SessionClosed, reason)) })
+}
+
+// goAway closes the session, telling the peer that we're shutting down
+func (r *refcntSession) goAway() error {
+	r.closing(ErrGoingAway)
+	return r.CloseWithError(ErrorCodeGoingAway, ErrGoingAway)
+}
+
+// track records path as open on the session until stream is closed.  Since a
+// new stream is a sign of life from the peer, it is also when we notice that
+// the peer's address has changed.
+func (r *refcntSession) track(path string, stream quic.Stream) {
+	addr := r.RemoteAddr().String()
+
+	r.pathsMu.Lock()
+	r.paths[path]++
+	migrated := addr != r.addr
+	r.addr = addr
+	r.pathsMu.Unlock()
+
+	if migrated {
+		r.emit(r.event(SessionMigrated, nil))
+	}
+
+	ctx.Defer(stream.Context(), func() {
+		r.pathsMu.Lock()
+		if r.paths[path]--; r.paths[path] <= 0 {
+			delete(r.paths, path)
+		}
+		if len(r.paths) == 0 {
+			r.idle = time.Now()
+		}
+		r.pathsMu.Unlock()
+	})
+}
+
+// idleFor returns how long no stream has been open on the session as of now
+func (r *refcntSession) idleFor(now time.Time) time.Duration {
+	r.pathsMu.Lock()
+	defer r.pathsMu.Unlock()
+
+	if len(r.paths) > 0 {
+		return 0
+	}
+	return now.Sub(r.idle)
 }
 
 func (r *refcntSession) Incr() *refcntSession {
@@ -236,8 +1050,17 @@ func (r *refcntSession) Incr() *refcntSession {
 	return r
 }
 
+// serve claims the streams opened by the peer on the session, and reports
+// whether the caller is the first to do so and should thus Serve the session.
+func (r *refcntSession) serve() bool { return atomic.CompareAndSwapInt32(&r.served, 0, 1) }
+
+// load returns the number of references held on the session, i.e. roughly the
+// number of streams open on it
+func (r *refcntSession) load() int32 { return atomic.LoadInt32(&r.refcnt) }
+
 func (r *refcntSession) DecrAndClose() (err error) {
 	if i := atomic.AddInt32(&r.refcnt, -1); i == 0 {
+		r.closing(ErrSessionUnused)
 		err = r.Close()
 		r.gc()
 	} else if i < 0 {
@@ -2,9 +2,16 @@ package quic
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"net"
 	"net/url"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 func TestNetloc(t *testing.T) {
@@ -26,103 +33,205 @@ func (b *bufCloser) Close() (err error) {
 	return
 }
 
-func TestNegotiator(t *testing.T) {
+func TestRouter(t *testing.T) {
+	r := newRouter()
+	rt := &route{ch: make(chan pendingConn)}
 	const path = "/some/path"
 
-	buf := &bufCloser{Buffer: new(bytes.Buffer)}
-	n := newNegotiator(buf)
+	t.Run("Add", func(t *testing.T) {
+		if !r.Add(path, rt) {
+			t.Errorf("failed to add route to path %s", path)
+		}
 
-	t.Run("PathNegotiation", func(t *testing.T) {
-		defer buf.Reset()
+		if r.Add(path, rt) {
+			t.Error("slot not detected as occupied")
+		}
+	})
 
-		t.Run("WriteHeaders", func(t *testing.T) {
-			if err := n.WriteHeaders(path); err != nil {
-				t.Error(err)
-			}
+	t.Run("Get", func(t *testing.T) {
+		if c, ok := r.Get(path); !ok {
+			t.Error("value not retrieved")
+		} else if c != rt {
+			t.Error("mismatch between retrieved values")
+		}
+	})
 
-			if buf.String() != path+"\n" {
-				t.Errorf("unexpected value in buffer: %v", buf.Bytes())
-			}
-		})
+	t.Run("Del", func(t *testing.T) {
+		r.Del(path)
+		if _, ok := r.Get(path); ok {
+			t.Error("value not deleted")
+		}
+	})
 
-		t.Run("Readheaders", func(t *testing.T) {
-			if p, err := n.ReadHeaders(); err != nil {
-				t.Error(err)
-			} else if p != path {
-				t.Errorf("expected path `%s`, got `%s`", path, p)
+	t.Run("Match", func(t *testing.T) {
+		r := newRouter()
+		routes := map[string]*route{}
+		for _, p := range []string{
+			"/",
+			"/rooms",
+			"/rooms/",
+			"/rooms/lobby",
+			"/rooms/:id",
+			"/rooms/:id/",
+			"/tenants/:id/events",
+			"/tenants/:id/:kind",
+			"/tenants/admin/:kind",
+		} {
+			routes[p] = &route{}
+			if !r.Add(p, routes[p]) {
+				t.Fatalf("failed to add route %s", p)
 			}
-		})
-	})
+		}
 
-	t.Run("Accept/Ack", func(t *testing.T) {
-		defer buf.Reset()
+		for _, tc := range []struct {
+			path, pattern, remainder string
+			params                   map[string]string
+		}{
+			{path: "/", pattern: "/"},
+			{path: "/rooms", pattern: "/rooms"},
+			{path: "/rooms/lobby", pattern: "/rooms/lobby"},
+			{path: "/rooms/42", pattern: "/rooms/:id", params: map[string]string{"id": "42"}},
+			{path: "/rooms/42/chat", pattern: "/rooms/:id/", remainder: "chat", params: map[string]string{"id": "42"}},
+			{path: "/rooms/42/chat/log", pattern: "/rooms/:id/", remainder: "chat/log", params: map[string]string{"id": "42"}},
+			{path: "/tenants/7/events", pattern: "/tenants/:id/events", params: map[string]string{"id": "7"}},
+			{path: "/tenants/7/metrics", pattern: "/tenants/:id/:kind", params: map[string]string{"id": "7", "kind": "metrics"}},
+			{path: "/tenants/admin/events", pattern: "/tenants/admin/:kind", params: map[string]string{"kind": "events"}},
+		} {
+			rt, m, ok := r.Match(tc.path)
+			if !ok {
+				t.Errorf("%s: no match", tc.path)
+				continue
+			}
 
-		t.Run("Accept", func(t *testing.T) {
-			if err := n.Accept(); err != nil {
-				t.Error(err)
+			if tc.params == nil {
+				tc.params = map[string]string{}
 			}
-		})
 
-		t.Run("Ack", func(t *testing.T) {
-			if err := n.Ack(); err != nil {
-				t.Error(err)
+			if rt != routes[tc.pattern] || m.pattern != tc.pattern {
+				t.Errorf("%s: expected pattern %s, got %s", tc.path, tc.pattern, m.pattern)
+			} else if m.remainder != tc.remainder {
+				t.Errorf("%s: expected remainder `%s`, got `%s`", tc.path, tc.remainder, m.remainder)
+			} else if !reflect.DeepEqual(m.params, tc.params) {
+				t.Errorf("%s: expected params %v, got %v", tc.path, tc.params, m.params)
+			} else if m.path != tc.path {
+				t.Errorf("%s: expected path %s, got %s", tc.path, tc.path, m.path)
 			}
-		})
-	})
+		}
 
-	t.Run("Abort/Ack", func(t *testing.T) {
-		defer buf.Reset()
+		for _, path := range []string{"/roomsx", "/tenants/7", "/tenants/7/events/x", "/nope"} {
+			if _, m, ok := r.Match(path); ok {
+				t.Errorf("%s: unexpected match with %s", path, m.pattern)
+			}
+		}
 
-		t.Run("Abort", func(t *testing.T) {
-			if err := n.Abort(404, "not found"); err != nil {
-				t.Error(err)
-			} else if buf.String() != "404:not found" {
-				t.Errorf("expected `404:not found`, got `%s`", buf.String())
+		t.Run("Subtree", func(t *testing.T) {
+			r.Del("/rooms")
+			if _, m, ok := r.Match("/rooms"); !ok || m.pattern != "/rooms/" {
+				t.Errorf("expected /rooms to match /rooms/, got %s", m.pattern)
 			}
 		})
 
-		t.Run("Ack", func(t *testing.T) {
-			if err := n.Ack(); err == nil {
-				t.Error("no error reported for aborted transaction")
+		t.Run("Equivalent", func(t *testing.T) {
+			if r.Add("/rooms/:name", &route{}) {
+				t.Error("equivalent pattern not detected as occupied")
 			}
 		})
 	})
 }
 
-func TestRouter(t *testing.T) {
-	r := newRouter()
-	ch := make(chan net.Conn)
-	const path = "/some/path"
+func TestRouteBacklog(t *testing.T) {
+	pending := func() (pendingConn, *mockStream) {
+		stream := newMockStream()
+		return pendingConn{conn: &conn{Stream: stream}, neg: newNegotiator(stream)}, stream
+	}
 
-	t.Run("Add", func(t *testing.T) {
-		if !r.Add(path, ch) {
-			t.Errorf("failed to add channel to path %s", path)
+	status := func(s *mockStream) (code uint16) {
+		if f, err := readFrame(s.Buffer); err == nil && f.kind == kindAbort {
+			code, _ = f.getUint16(fieldStatus)
 		}
+		return
+	}
 
-		if r.Add(path, ch) {
-			t.Error("slot not detected as occupied")
+	t.Run("Reject", func(t *testing.T) {
+		rt := &route{ch: make(chan pendingConn, 1), policy: BacklogReject}
+		first, s0 := pending()
+		second, s1 := pending()
+
+		rt.enqueue(first)
+		rt.enqueue(second)
+
+		if code := status(s1); code != StatusBusy {
+			t.Errorf("expected new stream aborted with %d, got %d", StatusBusy, code)
+		} else if p := <-rt.ch; p.conn != first.conn || s0.closed {
+			t.Error("queued stream not kept")
 		}
 	})
 
-	t.Run("Get", func(t *testing.T) {
-		if c, ok := r.Get(path); !ok {
-			t.Error("value not retrieved")
-		} else if c != ch {
-			t.Error("mismatch between retrieved values")
+	t.Run("DropOldest", func(t *testing.T) {
+		rt := &route{ch: make(chan pendingConn, 1), policy: BacklogDropOldest}
+		first, s0 := pending()
+		second, s1 := pending()
+
+		rt.enqueue(first)
+		rt.enqueue(second)
+
+		if code := status(s0); code != StatusBusy {
+			t.Errorf("expected oldest stream aborted with %d, got %d", StatusBusy, code)
+		} else if p := <-rt.ch; p.conn != second.conn || s1.closed {
+			t.Error("new stream not queued")
 		}
 	})
 
-	t.Run("Del", func(t *testing.T) {
-		r.Del(path)
-		if _, ok := r.Get(path); ok {
-			t.Error("value not deleted")
+	t.Run("Drain", func(t *testing.T) {
+		rt := &route{ch: make(chan pendingConn, 1), done: make(chan struct{})}
+		queued, s0 := pending()
+		rt.enqueue(queued)
+
+		close(rt.done)
+		late, s1 := pending()
+		rt.enqueue(late)
+
+		time.AfterFunc(time.Millisecond*20, rt.hold())
+
+		start := time.Now()
+		rt.drain(time.Second)
+
+		if time.Since(start) >= time.Second {
+			t.Error("drain did not return once accepted streams were closed")
+		} else if code := status(s0); code != StatusUnavailable {
+			t.Errorf("expected queued stream aborted with %d, got %d", StatusUnavailable, code)
+		} else if code = status(s1); code != StatusUnavailable {
+			t.Errorf("expected late stream aborted with %d, got %d", StatusUnavailable, code)
+		}
+
+		t.Run("Timeout", func(t *testing.T) {
+			defer rt.hold()()
+
+			start := time.Now()
+			if rt.drain(time.Millisecond * 20); time.Since(start) < time.Millisecond*20 {
+				t.Error("drain returned before its timeout")
+			}
+		})
+	})
+
+	t.Run("Accept", func(t *testing.T) {
+		p, s := pending()
+		p.resp = response{codec: CodecFlate}
+
+		c, err := p.accept()
+		if err != nil {
+			t.Fatal(err)
+		} else if f, err := readFrame(s.Buffer); err != nil || f.kind != kindAccept {
+			t.Errorf("expected accept frame, got %v (%v)", f.kind, err)
+		} else if c.(*conn).codec == nil {
+			t.Error("codec not applied on accept")
 		}
 	})
 }
 
 func TestRefcntSession(t *testing.T) {
 	sess := &mockSess{}
-	rfcs := newRefCntSession(sess, newMux())
+	rfcs := newRefCntSession(sess, "", newMux())
 
 	t.Run("CtrDefault=0", func(t *testing.T) {
 		if rfcs.refcnt != 0 {
@@ -166,6 +275,126 @@ func TestRefcntSession(t *testing.T) {
 	})
 }
 
+func TestReaper(t *testing.T) {
+	const idle = time.Minute
+
+	m := newMux()
+	add := func(key string, inbound bool) (*refcntSession, *mockSess) {
+		ms := &mockSess{}
+		sess := newRefCntSession(ms, key, m)
+		if sess.inbound = inbound; inbound {
+			m.AddInbound(key, sess.Incr())
+		} else {
+			m.AddSession(key, sess.Incr())
+		}
+		return sess, ms
+	}
+
+	_, idleSess := add("idle", true)
+	_, dialed := add("dialed", false)
+	busy, busySess := add("busy", true)
+
+	c, closeStream := context.WithCancel(context.Background())
+	busy.track("/p", ctxStream{newMockStream(), c})
+	now := time.Now()
+
+	t.Run("Idle", func(t *testing.T) {
+		m.reapIdle(now.Add(idle-time.Second), idle)
+		if closed, _ := idleSess.closeCode(); closed {
+			t.Error("session reaped before its idle timeout")
+		}
+
+		m.reapIdle(now.Add(idle), idle)
+		if closed, code := idleSess.closeCode(); !closed || code != ErrorCodeGoingAway {
+			t.Errorf("expected idle session closed with %x, got %v/%x", ErrorCodeGoingAway, closed, code)
+		} else if _, ok := m.GetInbound("idle"); ok {
+			t.Error("idle session not removed")
+		}
+	})
+
+	t.Run("Dialed", func(t *testing.T) {
+		if closed, _ := dialed.closeCode(); closed {
+			t.Error("dialed session reaped")
+		}
+	})
+
+	t.Run("Busy", func(t *testing.T) {
+		if closed, _ := busySess.closeCode(); closed {
+			t.Fatal("session with an open stream reaped")
+		}
+
+		closeStream()
+		for deadline := time.Now().Add(time.Second); busy.idleFor(time.Now()) == 0; {
+			if time.Now().After(deadline) {
+				t.Fatal("session not idle once its stream was closed")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		m.reapIdle(time.Now().Add(idle), idle)
+		if closed, _ := busySess.closeCode(); !closed {
+			t.Error("session not reaped once idle")
+		}
+	})
+
+	t.Run("SetPipeIdleTimeout", func(t *testing.T) {
+		_, ms := add("timer", true)
+		m.SetPipeIdleTimeout(time.Millisecond)
+		defer m.SetPipeIdleTimeout(0)
+
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+			if closed, _ := ms.closeCode(); closed {
+				break
+			} else if time.Now().After(deadline) {
+				t.Fatal("reaper did not close idle session")
+			}
+		}
+	})
+}
+
+func TestSharedConn(t *testing.T) {
+	m := newMux()
+
+	var opened []*mockPacketConn
+	m.network = mockNetwork(func(addr string) (net.PacketConn, error) {
+		if addr != "127.0.0.1:9001" {
+			t.Errorf("expected resolved address 127.0.0.1:9001, got %s", addr)
+		}
+		opened = append(opened, &mockPacketConn{})
+		return opened[len(opened)-1], nil
+	})
+
+	a, err := m.LoadConn("127.0.0.1:9001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := m.LoadConn("localhost:9001")
+	if err != nil {
+		t.Fatal(err)
+	} else if a != b || len(opened) != 1 {
+		t.Fatalf("expected a single socket, got %d", len(opened))
+	}
+
+	if _, err := m.LoadConn("127.0.0.1"); err == nil {
+		t.Error("expected error for missing port")
+	}
+
+	if err := m.ReleaseConn(a); err != nil {
+		t.Error(err)
+	} else if opened[0].closed {
+		t.Error("socket closed while still referenced")
+	}
+
+	if err := m.ReleaseConn(b); err != nil {
+		t.Error(err)
+	} else if !opened[0].closed {
+		t.Error("socket not closed")
+	} else if len(m.conns) != 0 {
+		t.Error("socket still registered")
+	}
+}
+
 func TestMultiplexer(t *testing.T) {
 	mx := newMux()
 	u, _ := url.ParseRequestURI("quic://127.0.0.1:9001/hello")
@@ -203,10 +432,10 @@ func TestMultiplexer(t *testing.T) {
 
 	t.Run("TestSessionOps", func(t *testing.T) {
 
-		rfcs := new(refcntSession)
+		rfcs := &refcntSession{key: n.String()}
 
 		t.Run("AddSession", func(t *testing.T) {
-			mx.AddSession(mockAddrNetloc(n.String()), rfcs)
+			mx.AddSession(n.String(), rfcs)
 
 			if s, ok := mx.sessions[n.String()]; !ok {
 				t.Error("session was not added to map")
@@ -216,7 +445,7 @@ func TestMultiplexer(t *testing.T) {
 		})
 
 		t.Run("GetSession", func(t *testing.T) {
-			if s, ok := mx.GetSession(mockAddrNetloc(n.String())); !ok {
+			if s, ok := mx.GetSession(n.String()); !ok {
 				t.Error("session was not found in map")
 			} else if s != rfcs {
 				t.Error("session pointer mismatch")
@@ -224,25 +453,46 @@ func TestMultiplexer(t *testing.T) {
 		})
 
 		t.Run("DelSession", func(t *testing.T) {
-			mx.DelSession(mockAddrNetloc(n.String()))
+			mx.DelSession(rfcs)
 			if _, ok := mx.sessions[n.String()]; ok {
 				t.Error("session not removed")
 			}
 		})
+
+		t.Run("Inbound", func(t *testing.T) {
+			dialed := &refcntSession{key: n.String()}
+			inbound := &refcntSession{key: n.String(), inbound: true}
+			mx.AddSession(dialed.key, dialed)
+			mx.AddInbound(inbound.key, inbound)
+
+			if s, _ := mx.GetSession(n.String()); s != dialed {
+				t.Error("dialed session clobbered by inbound session")
+			} else if s, _ = mx.GetInbound(n.String()); s != inbound {
+				t.Error("inbound session clobbered by dialed session")
+			}
+
+			mx.DelSession(inbound)
+			if _, ok := mx.GetInbound(n.String()); ok {
+				t.Error("inbound session not removed")
+			} else if _, ok = mx.GetSession(n.String()); !ok {
+				t.Error("dialed session removed along with inbound session")
+			}
+			mx.DelSession(dialed)
+		})
 	})
 
 	t.Run("TestRouterOps", func(t *testing.T) {
 		t.Run("RegisterPath", func(t *testing.T) {
-			ch := make(chan net.Conn)
+			rt := &route{ch: make(chan pendingConn)}
 
 			t.Run("SlotFree", func(t *testing.T) {
-				if err := mx.RegisterPath(n.Path, ch); err != nil {
+				if err := mx.RegisterPath(n.Path, rt); err != nil {
 					t.Error(err)
 				}
 			})
 
 			t.Run("SlotOccupied", func(t *testing.T) {
-				if err := mx.RegisterPath(n.Path, ch); err == nil {
+				if err := mx.RegisterPath(n.Path, rt); err == nil {
 					t.Errorf("expected %s to be occupied, was free", n.Path)
 				}
 			})
@@ -262,12 +512,306 @@ func TestMultiplexer(t *testing.T) {
 			})
 		})
 
-		// t.Run("Serve", func(t *testing.T) {
-		// this is too hard to test for now ... :/
-		// })
+		t.Run("Serve", func(t *testing.T) {
+			c, cancel := context.WithCancel(context.Background())
+			sess := &mockSess{contextFactory: func() context.Context { return c }}
+
+			done := make(chan struct{})
+			go func() {
+				mx.Serve(n, sess)
+				close(done)
+			}()
+
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Error("Serve did not return once the session was closed")
+			}
+		})
+
+		t.Run("routeStream", func(t *testing.T) {
+			const path = "/route/stream"
+			ch := make(chan pendingConn, 1)
+			conns := make(chan net.Conn, 1) // streams accepted from ch
+			pub := &spProto{number: 0x20, peer: 0x21}
+			sub := &spProto{number: 0x21, peer: 0x20}
+			req := &spProto{number: 0x30, peer: 0x31}
+
+			rt := &route{ch: ch, proto: pub, negotiation: time.Millisecond * 10, netlocs: []string{n.Netloc()}}
+			if err := mx.RegisterPath(path, rt); err != nil {
+				t.Fatal(err)
+			}
+			defer mx.UnregisterPath(path)
+
+			negotiate := func(r request) (response, error) {
+				stream := newMockStream()
+				neg := newNegotiator(stream)
+				if err := neg.WriteHeaders(r); err != nil {
+					t.Fatal(err)
+				}
+
+				mx.routeStream(n, &mockSess{}, stream)
+				select {
+				case p := <-ch:
+					if c, err := p.accept(); err == nil {
+						conns <- c
+					}
+				default:
+				}
+				return neg.Ack()
+			}
+
+			t.Run("NotFound", func(t *testing.T) {
+				if _, err := negotiate(request{path: "/nope"}); !ErrRouteNotFound.Is(err) {
+					t.Errorf("expected route not found, got %v", err)
+				}
+			})
+
+			t.Run("ProtocolMismatch", func(t *testing.T) {
+				if _, err := negotiate(request{path: path, proto: req}); !ErrProtocolMismatch.Is(err) {
+					t.Errorf("expected protocol mismatch, got %v", err)
+				}
+
+				select {
+				case <-conns:
+					t.Error("mismatched stream was routed")
+				default:
+				}
+			})
+
+			t.Run("Compatible", func(t *testing.T) {
+				resp, err := negotiate(request{path: path, proto: sub})
+				if err != nil {
+					t.Fatal(err)
+				} else if resp.proto == nil || *resp.proto != *pub {
+					t.Errorf("expected protocol %v, got %v", pub, resp.proto)
+				}
+
+				if c := (<-conns).(*conn); c.peer == nil || *c.peer != *sub {
+					t.Errorf("expected peer protocol %v, got %v", sub, c.peer)
+				}
+			})
+
+			t.Run("Timeout", func(t *testing.T) {
+				stream := newStallStream()
 
-		// t.Run("routeStream", func(t *testing.T) {
-		// this is too hard to test for now ... :/
-		// })
+				done := make(chan struct{})
+				go func() {
+					mx.routeStream(n, &mockSess{}, stream)
+					close(done)
+				}()
+
+				select {
+				case <-done:
+				case <-time.After(time.Second):
+					t.Fatal("routeStream did not time out")
+				}
+
+				if f, err := readFrame(stream.Buffer); err != nil {
+					t.Error(err)
+				} else if code, _ := f.getUint16(fieldStatus); f.kind != kindAbort || code != StatusTimeout {
+					t.Errorf("expected abort with status %d, got %d", StatusTimeout, code)
+				} else if !stream.closed {
+					t.Error("stream not closed")
+				}
+			})
+
+			t.Run("PerRoute", func(t *testing.T) {
+				const slow = "/route/slow"
+				backlog := make(chan pendingConn, 1)
+				if err := mx.RegisterPath(slow, &route{ch: backlog, negotiation: time.Hour, netlocs: []string{n.Netloc()}}); err != nil {
+					t.Fatal(err)
+				}
+				defer mx.UnregisterPath(slow)
+
+				for p, want := range map[string]time.Duration{path: rt.negotiation, slow: time.Hour} {
+					stream := &deadlineStream{mockStream: newMockStream()}
+					if err := newNegotiator(stream).WriteHeaders(request{path: p}); err != nil {
+						t.Fatal(err)
+					}
+
+					start := time.Now()
+					mx.routeStream(n, &mockSess{}, stream)
+					if d := stream.deadline.Sub(start); d < want || d > want+time.Second {
+						t.Errorf("%s: expected a deadline %s out, got %s", p, want, d)
+					}
+				}
+
+				<-ch
+				<-backlog
+			})
+
+			t.Run("Fallback", func(t *testing.T) {
+				var probed string
+				fallback := func(path string, h Headers) (string, error) {
+					if probed = path; h["tenant"] == "banned" {
+						return "", ErrForbidden
+					} else if path == "/gone" {
+						return "", &NegotiationError{Code: 410, Message: "gone"}
+					}
+					return path, errors.New("no such thing")
+				}
+
+				if err := mx.SetFallback(n, fallback); err != nil {
+					t.Fatal(err)
+				}
+				defer mx.DelFallback(n)
+
+				if err := mx.SetFallback(n, FallbackTo(path)); err == nil {
+					t.Error("fallback slot not detected as occupied")
+				}
+
+				if _, err := negotiate(request{path: "/nope"}); !ErrRouteNotFound.Is(err) {
+					t.Errorf("expected route not found, got %v", err)
+				} else if probed != "/nope" {
+					t.Errorf("fallback not called for /nope")
+				}
+
+				if _, err := negotiate(request{path: "/gone"}); err == nil || err.(*NegotiationError).Code != 410 {
+					t.Errorf("expected custom status, got %v", err)
+				}
+
+				h := Headers{"tenant": "banned"}
+				if _, err := negotiate(request{path: "/nope", headers: h}); !ErrForbidden.Is(err) {
+					t.Errorf("expected forbidden, got %v", err)
+				}
+
+				t.Run("Redirect", func(t *testing.T) {
+					mx.DelFallback(n)
+					if err := mx.SetFallback(n, RedirectTo("example.com:9001")); err != nil {
+						t.Fatal(err)
+					}
+
+					_, err := negotiate(request{path: "/moved"})
+					if rd, ok := err.(*Redirect); !ok {
+						t.Errorf("expected *Redirect, got %v", err)
+					} else if rd.Code != StatusMovedPermanently || rd.Netloc != "example.com:9001" || rd.Path != "" {
+						t.Errorf("unexpected redirect %s", rd)
+					}
+				})
+
+				t.Run("CatchAll", func(t *testing.T) {
+					mx.DelFallback(n)
+					if err := mx.SetFallback(n, FallbackTo(path)); err != nil {
+						t.Fatal(err)
+					}
+
+					if _, err := negotiate(request{path: "/nope"}); err != nil {
+						t.Fatal(err)
+					}
+
+					if c := (<-conns).(*conn); c.match.path != "/nope" || c.match.pattern != path {
+						t.Errorf("expected /nope routed to %s, got %s routed to %s",
+							path, c.match.path, c.match.pattern)
+					}
+				})
+			})
+
+			t.Run("UnknownProtocol", func(t *testing.T) {
+				if _, err := negotiate(request{path: path}); err != nil {
+					t.Fatal(err)
+				}
+
+				if c := (<-conns).(*conn); c.peer != nil {
+					t.Error("SP header exchange should not be skipped")
+				}
+			})
+
+			t.Run("Compression", func(t *testing.T) {
+				const zpath = "/route/compressed"
+				if err := mx.RegisterPath(zpath, &route{ch: ch, codecs: []string{CodecFlate}}); err != nil {
+					t.Fatal(err)
+				}
+				defer mx.UnregisterPath(zpath)
+
+				resp, err := negotiate(request{path: zpath, codecs: []string{"zstd", CodecFlate}})
+				if err != nil {
+					t.Fatal(err)
+				} else if resp.codec != CodecFlate {
+					t.Errorf("expected codec %s, got `%s`", CodecFlate, resp.codec)
+				} else if c := (<-conns).(*conn); c.codec == nil {
+					t.Error("stream not compressed")
+				}
+
+				if resp, err = negotiate(request{path: zpath, codecs: []string{"zstd"}}); err != nil {
+					t.Fatal(err)
+				} else if resp.codec != "" {
+					t.Errorf("expected no codec, got %s", resp.codec)
+				} else if c := (<-conns).(*conn); c.codec != nil {
+					t.Error("stream compressed without a common codec")
+				}
+			})
+
+			t.Run("Discovery", func(t *testing.T) {
+				stream := newMockStream()
+				neg := newNegotiator(stream)
+				if err := neg.WriteHeaders(request{path: DiscoveryPath}); err != nil {
+					t.Fatal(err)
+				}
+
+				mx.routeStream(n, &mockSess{}, stream)
+				if _, err := neg.Ack(); err != nil {
+					t.Fatal(err)
+				}
+
+				want := []RouteInfo{{Path: path, Protocol: pub.number, PeerProtocol: pub.peer}}
+				if f, err := readFrame(stream); err != nil {
+					t.Error(err)
+				} else if routes, err := decodeRoutes(f); err != nil {
+					t.Error(err)
+				} else if !reflect.DeepEqual(routes, want) {
+					t.Errorf("expected routes %v, got %v", want, routes)
+				} else if !stream.closed {
+					t.Error("stream not closed")
+				}
+
+				t.Run("OtherNetloc", func(t *testing.T) {
+					const other = "/other/netloc"
+					if err := mx.RegisterPath(other, &route{netlocs: []string{"elsewhere:9001"}}); err != nil {
+						t.Fatal(err)
+					}
+					defer mx.UnregisterPath(other)
+
+					stream := newMockStream()
+					neg := newNegotiator(stream)
+					_ = neg.WriteHeaders(request{path: DiscoveryPath})
+					mx.routeStream(n, &mockSess{}, stream)
+					if _, err := neg.Ack(); err != nil {
+						t.Fatal(err)
+					}
+
+					if f, err := readFrame(stream); err != nil {
+						t.Error(err)
+					} else if routes, _ := decodeRoutes(f); !reflect.DeepEqual(routes, want) {
+						t.Errorf("expected routes %v, got %v", want, routes)
+					}
+				})
+
+				t.Run("TooLarge", func(t *testing.T) {
+					long := strings.Repeat("x", 1024)
+					for i := 0; i < 64; i++ {
+						p := fmt.Sprintf("/large/%d/%s", i, long)
+						if err := mx.RegisterPath(p, &route{netlocs: []string{n.Netloc()}}); err != nil {
+							t.Fatal(err)
+						}
+						defer mx.UnregisterPath(p)
+					}
+
+					if _, err := negotiate(request{path: DiscoveryPath}); !ErrUnavailable.Is(err) {
+						t.Errorf("expected unavailable, got %v", err)
+					}
+				})
+
+				t.Run("Disabled", func(t *testing.T) {
+					mx.HideRoutes(n)
+					defer mx.ShowRoutes(n)
+
+					if _, err := negotiate(request{path: DiscoveryPath}); !ErrRouteNotFound.Is(err) {
+						t.Errorf("expected route not found, got %v", err)
+					}
+				})
+			})
+		})
 	})
 }
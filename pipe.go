@@ -0,0 +1,106 @@
+package quic
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/nanomsg/mangos"
+)
+
+// newPipe wraps a negotiated connection in a mangos.Pipe.  If both peers
+// exchanged their SP protocols during path negotiation, the header exchange
+// performed by mangos.NewConnPipe would be a redundant round trip, so it is
+// skipped.
+func newPipe(c net.Conn, sock mangos.Socket) (mangos.Pipe, error) {
+	qc, ok := c.(*conn)
+	if !ok {
+		return mangos.NewConnPipe(c, sock)
+	} else if qc.peer == nil {
+		return mangos.NewConnPipe(c, sock, qc.props()...)
+	}
+
+	p := &streamPipe{
+		c:      qc,
+		local:  sockProto(sock).number,
+		remote: qc.peer.number,
+		props:  make(map[string]interface{}),
+		open:   1,
+	}
+
+	if v, err := sock.GetOption(mangos.OptionMaxRecvSize); err == nil {
+		p.maxrx = int64(v.(int))
+	}
+
+	props := qc.props()
+	for i := 0; i < len(props); i += 2 {
+		p.props[props[i].(string)] = props[i+1]
+	}
+
+	return p, nil
+}
+
+// streamPipe is a mangos.Pipe over a negotiated stream.  Messages are framed
+// exactly as they are by mangos.NewConnPipe, i.e. prefixed with their length as
+// a big-endian uint64.
+type streamPipe struct {
+	c             *conn
+	local, remote uint16
+	maxrx         int64
+	props         map[string]interface{}
+	open          int32
+}
+
+func (p *streamPipe) Send(msg *mangos.Message) error {
+	l := uint64(len(msg.Header) + len(msg.Body))
+
+	if err := binary.Write(p.c, binary.BigEndian, l); err != nil {
+		return err
+	} else if _, err = p.c.Write(msg.Header); err != nil {
+		return err
+	} else if _, err = p.c.Write(msg.Body); err != nil {
+		return err
+	}
+
+	msg.Free()
+	return nil
+}
+
+func (p *streamPipe) Recv() (*mangos.Message, error) {
+	var sz int64
+	if err := binary.Read(p.c, binary.BigEndian, &sz); err != nil {
+		return nil, err
+	}
+
+	// Limit messages to the maximum receive size, if any, so that a peer
+	// cannot make us allocate arbitrary amounts of memory.
+	if sz < 0 || (p.maxrx > 0 && sz > p.maxrx) {
+		return nil, mangos.ErrTooLong
+	}
+
+	msg := mangos.NewMessage(int(sz))
+	msg.Body = msg.Body[0:sz]
+	if _, err := io.ReadFull(p.c, msg.Body); err != nil {
+		msg.Free()
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (p *streamPipe) Close() error {
+	atomic.StoreInt32(&p.open, 0)
+	return p.c.Close()
+}
+
+func (p *streamPipe) LocalProtocol() uint16  { return p.local }
+func (p *streamPipe) RemoteProtocol() uint16 { return p.remote }
+func (p *streamPipe) IsOpen() bool           { return atomic.LoadInt32(&p.open) == 1 }
+
+func (p *streamPipe) GetProp(name string) (interface{}, error) {
+	if v, ok := p.props[name]; ok {
+		return v, nil
+	}
+	return nil, mangos.ErrBadProperty
+}
@@ -3,6 +3,7 @@ package quic
 import (
 	"net/url"
 	"path/filepath"
+	"time"
 
 	"github.com/nanomsg/mangos"
 	quic "github.com/lucas-clemente/quic-go"
@@ -12,16 +13,170 @@ import (
 const (
 	// OptionTLSConfig maps to a *tls.Config value
 	OptionTLSConfig = "QUIC-TLS-CONFIG"
-	// OptionQUICConfig maps to a *quic.Config value
+	// OptionQUICConfig maps to a *quic.Config value.  The typed options below,
+	// e.g. OptionIdleTimeout, take precedence over the fields they set, which
+	// are overridden in a copy of the config.
 	OptionQUICConfig = "QUIC-UDP-CONFIG"
-	// OptionAcceptTimeout limits the amount of time we wait to accept a connection
+	// OptionHeaders maps to a Headers value, which is sent to the listener
+	// when a dialer negotiates its path
+	OptionHeaders = "QUIC-HEADERS"
+	// OptionNegotiationTimeout maps to a time.Duration bounding the path
+	// negotiation at the start of each stream.  A zero value disables it.
+	OptionNegotiationTimeout = "QUIC-NEGOTIATION-TIMEOUT"
+	// OptionCompression maps to a []string of compression codecs, e.g.
+	// []string{CodecFlate}.  Dialers offer them in order of preference, and
+	// listeners pick the first offered codec they also accept.  Streams are
+	// left uncompressed unless both sides set this option.
+	OptionCompression = "QUIC-COMPRESSION"
+	// OptionFallback maps to a FallbackFunc, which a listener registers for
+	// streams on its netloc whose path matches no route
+	OptionFallback = "QUIC-FALLBACK"
+	// OptionDiscovery maps to a bool.  Setting it to false on a listener stops
+	// its netloc from answering on DiscoveryPath.  Discovery is enabled by
+	// default.
+	OptionDiscovery = "QUIC-DISCOVERY"
+	// OptionMaxSessions maps to an int bounding the number of sessions a
+	// transport dials to a single peer.  Further sessions are dialed when the
+	// existing ones run out of streams.  Defaults to 1.
+	OptionMaxSessions = "QUIC-MAX-SESSIONS"
+	// OptionSessionPolicy maps to a SessionPolicy, which decides the session
+	// on which a dialer negotiates its path.  Defaults to PolicyFill.
+	OptionSessionPolicy = "QUIC-SESSION-POLICY"
+	// OptionReverse maps to a bool, and lets peers behind a NAT serve paths to
+	// the listeners they dial.  A listener with this option set does not
+	// listen on its address; it dials it, and serves its path to the peer over
+	// the outbound session.  A dialer with this option set does not dial its
+	// address; it opens its stream over the session accepted from the peer at
+	// that address, e.g. the PropRemoteAddr of a pipe accepted from it.
+	OptionReverse = "QUIC-REVERSE"
+	// OptionBacklog maps to an int bounding the number of negotiated streams
+	// that may await a call to Accept on a listener.  Defaults to 128.
+	OptionBacklog = "QUIC-BACKLOG"
+	// OptionBacklogPolicy maps to a BacklogPolicy, which decides what becomes
+	// of streams negotiated while the backlog is full.  Defaults to
+	// BacklogReject.
+	OptionBacklogPolicy = "QUIC-BACKLOG-POLICY"
+	// OptionDrainTimeout maps to a time.Duration.  A listener being closed
+	// stops accepting streams, and waits up to this long for the pipes it
+	// accepted to be closed before it closes its sessions with
+	// ErrorCodeGoingAway.  Defaults to 0, i.e. no wait.
+	OptionDrainTimeout = "QUIC-DRAIN-TIMEOUT"
+	// OptionSharedSocket maps to a bool.  A listener with this option set
+	// listens on a UDP socket owned by the transport, from which dialers may
+	// also dial, see OptionLocalAddr.  Defaults to false.
+	OptionSharedSocket = "QUIC-SHARED-SOCKET"
+	// OptionLocalAddr maps to a string holding a local UDP address, e.g.
+	// "0.0.0.0:9001".  A dialer with this option set dials from the transport's
+	// socket bound to that address, opening it if needed, rather than from a
+	// fresh ephemeral port.  Peers thus see sessions dialed by a node leave
+	// from the port it listens on, as needed for NAT traversal.  Defaults to
+	// "", i.e. unset.
+	OptionLocalAddr = "QUIC-LOCAL-ADDR"
+	// OptionBoundAddr is a read-only listener option mapping to the net.Addr
+	// the listener is bound to, e.g. to find out the port picked for
+	// quic://127.0.0.1:0/path.  Address() reports it too, once listening.
+	OptionBoundAddr = "QUIC-BOUND-ADDR"
+	// OptionAcceptTimeout maps to a time.Duration bounding each call to Accept
+	// on a listener, which then fails with ErrAcceptTimeout.  A zero value, the
+	// default, waits forever.
+	OptionAcceptTimeout = "QUIC-ACCEPT-TIMEOUT"
+	// OptionDialTimeout maps to a time.Duration bounding each call to Dial on a
+	// dialer, from dialing the session to negotiating the path, redirects
+	// included.  Dial then fails with ErrDialTimeout.  A zero value, the
+	// default, leaves each step to its own timeout.
+	OptionDialTimeout = "QUIC-DIAL-TIMEOUT"
+	// OptionHandshakeTimeout maps to a time.Duration bounding the QUIC
+	// handshake of each session, and overrides the HandshakeTimeout of
+	// OptionQUICConfig.  Dialers whose handshake times out fail with
+	// ErrHandshakeTimeout.  A zero value, the default, keeps quic-go's.
+	OptionHandshakeTimeout = "QUIC-HANDSHAKE-TIMEOUT"
+	// OptionIdleTimeout maps to a time.Duration after which sessions with no
+	// network activity are closed, and overrides the IdleTimeout of
+	// OptionQUICConfig.  A zero value, the default, keeps quic-go's.
+	OptionIdleTimeout = "QUIC-IDLE-TIMEOUT"
+	// OptionKeepAlive maps to a bool, and overrides the KeepAlive of
+	// OptionQUICConfig.  Sessions with keepalives enabled ping their peer so
+	// as not to reach their idle timeout.  Unset by default.
+	OptionKeepAlive = "QUIC-KEEPALIVE"
+	// OptionMaxIncomingStreams maps to a positive int bounding the number of
+	// streams a peer may open at once on each session, and overrides the
+	// MaxIncomingStreams of OptionQUICConfig.  Dialers open further streams on
+	// other sessions, see OptionMaxSessions.  A zero value, the default, keeps
+	// quic-go's.
+	OptionMaxIncomingStreams = "QUIC-MAX-INCOMING-STREAMS"
 )
 
-type transport struct{}
+const (
+	// PropHeaders maps to the Headers sent by the dialer of an accepted pipe
+	PropHeaders = "QUIC-HEADERS"
+	// PropPath maps to the path requested by the dialer of an accepted pipe
+	PropPath = "QUIC-PATH"
+	// PropRoute maps to the path of the listener that accepted the pipe, e.g.
+	// "/tenants/:id/events" or "/rooms/"
+	PropRoute = "QUIC-ROUTE"
+	// PropParams maps to a map[string]string holding the values of the
+	// route's parameters, e.g. {"id": "42"}
+	PropParams = "QUIC-PARAMS"
+	// PropRemainder maps to the part of the path beneath a subtree route,
+	// e.g. "42" when "/rooms/42" is dialed on "/rooms/"
+	PropRemainder = "QUIC-REMAINDER"
+)
+
+// SessionPolicy decides how paths dialed to the same peer are spread across
+// sessions, up to OptionMaxSessions
+type SessionPolicy int
+
+const (
+	// PolicyFill dials every path on the same session, dialing another only
+	// once it runs out of streams
+	PolicyFill SessionPolicy = iota
+	// PolicySpread dials a new session for each path until the pool is full,
+	// after which each path goes to the least loaded session
+	PolicySpread
+)
+
+// BacklogPolicy decides what becomes of a stream negotiated on a listener whose
+// accept backlog is full.  Rejected streams are aborted with StatusBusy.
+type BacklogPolicy int
 
-func (transport) Scheme() string { return "quic" }
+const (
+	// BacklogReject rejects the new stream
+	BacklogReject BacklogPolicy = iota
+	// BacklogDropOldest rejects the stream that has waited the longest, and
+	// queues the new stream in its stead
+	BacklogDropOldest
+)
+
+// Transport is a quic:// transport.  Each Transport owns the QUIC listeners and
+// sessions created through it, which are shared by its sockets.
+type Transport struct {
+	mux *multiplexer
+	mem *memNetwork // set for quic+mem:// transports
+}
 
-func (t transport) NewDialer(addr string, sock mangos.Socket) (mangos.PipeDialer, error) {
+// NewTransport allocates a new quic:// transport.
+func NewTransport() *Transport { return &Transport{mux: newMux()} }
+
+// NewMemTransport allocates a new quic+mem:// transport, which runs QUIC over
+// in-memory sockets rather than UDP, e.g. for tests.  The host of a quic+mem://
+// URL is any name, e.g. quic+mem://server/path, which is only reachable from
+// sockets using the same transport.
+func NewMemTransport() *Transport {
+	mem, m := newMemNetwork(), newMux()
+	m.network = mem
+	return &Transport{mux: m, mem: mem}
+}
+
+// Scheme returns the URL scheme of the transport
+func (t *Transport) Scheme() string {
+	if t.mem != nil {
+		return "quic+mem"
+	}
+	return "quic"
+}
+
+// NewDialer is called by mangos when a socket dials a quic:// address
+func (t *Transport) NewDialer(addr string, sock mangos.Socket) (mangos.PipeDialer, error) {
 	u, err := url.ParseRequestURI(addr)
 	if err != nil {
 		return nil, errors.Wrap(err, "url parse")
@@ -33,25 +188,55 @@ func (t transport) NewDialer(addr string, sock mangos.Socket) (mangos.PipeDialer
 		netloc:  netloc{u},
 		sock:    sock,
 		opt:     newOpt(),
-		dialMux: newDialMux(sock, mux),
+		dialMux: newDialMux(sock, t.mux),
 	}, nil
 }
 
-func (t transport) NewListener(addr string, sock mangos.Socket) (mangos.PipeListener, error) {
+// NewListener is called by mangos when a socket listens on a quic:// address.
+// The address may list several hosts, e.g. quic://[::]:9001,0.0.0.0:9001/path,
+// to listen on each of them.
+func (t *Transport) NewListener(addr string, sock mangos.Socket) (mangos.PipeListener, error) {
+	addr, hosts := splitHosts(addr)
 	u, err := url.ParseRequestURI(addr)
 	if err != nil {
 		return nil, errors.Wrap(err, "url parse")
 	}
 
-	u.Path = filepath.Clean(u.Path)
+	u.Path = cleanPath(u.Path)
+
+	var extra []netloc
+	for _, h := range hosts[1:] {
+		if h == "" {
+			return nil, errors.Errorf("url parse: empty host in %s", addr)
+		}
+		extra = append(extra, netloc{&url.URL{Scheme: u.Scheme, Host: h, Path: u.Path}})
+	}
 
-	return &listener{
+	lm := newListenMux(t.mux, quic.ListenAddr)
+	l := &listener{
 		netloc:    netloc{u},
+		extra:     extra,
 		sock:      sock,
 		opt:       newOpt(),
-		listenMux: newListenMux(mux, quic.ListenAddr),
-	}, nil
+		listenMux: lm,
+	}
+
+	switch {
+	case t.mem != nil:
+		lm.factory = lm.listenShared(quic.Listen)
+	case spansFamilies(l.netlocs()):
+		lm.factory = listenFamily
+	}
+	return l, nil
 }
 
-// NewTransport allocates a new quic:// transport.
-func NewTransport() mangos.Transport { return transport{} }
+// SetPipeIdleTimeout closes the sessions accepted by the transport's listeners
+// once no pipe has been open on them for d, rather than wait for QUIC's own idle
+// timeout, see OptionIdleTimeout, which keepalives may defeat.  Their peers see
+// ErrorCodeGoingAway, and dial a fresh session for their next pipe.  A zero
+// duration, the default, disables the reaper.
+func (t *Transport) SetPipeIdleTimeout(d time.Duration) { t.mux.SetPipeIdleTimeout(d) }
+
+// Close tears down every listener and session owned by the transport.  Pending
+// calls to Accept on its listeners fail with mangos.ErrClosed.
+func (t *Transport) Close() error { return t.mux.Close() }
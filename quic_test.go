@@ -1,8 +1,11 @@
 package quic
 
 import (
+	"net"
 	"testing"
+	"time"
 
+	quic "github.com/lucas-clemente/quic-go"
 	"github.com/nanomsg/mangos"
 )
 
@@ -19,22 +22,26 @@ func TestNewDialer(t *testing.T) {
 	trans := NewTransport()
 
 	t.Run("SuccessfulInit", func(t *testing.T) {
-		addr := "quic://127.0.0.1:9001/clean//up/"
+		for _, trans := range []*Transport{trans, NewMemTransport()} {
+			addr := trans.Scheme() + "://127.0.0.1:9001/clean//up/"
 
-		p, err := trans.NewDialer(addr, sock)
-		if err != nil {
-			t.Error(err)
-		}
-		d := p.(*dialer)
+			p, err := trans.NewDialer(addr, sock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := p.(*dialer)
 
-		if d.Path != "/clean/up" {
-			t.Errorf("expected /clean/up, got %s", d.Path)
-		}
+			if d.Path != "/clean/up" {
+				t.Errorf("expected /clean/up, got %s", d.Path)
+			}
 
-		if d.sock != sock {
-			t.Error("sock parameter points to unexpected location")
-		} else if d.dialMux == nil {
-			t.Error("muxDialer is nil")
+			if d.sock != sock {
+				t.Error("sock parameter points to unexpected location")
+			} else if d.dialMux == nil {
+				t.Error("muxDialer is nil")
+			} else if d.mux != trans.mux {
+				t.Error("dialer not bound to its transport's multiplexer")
+			}
 		}
 	})
 
@@ -51,22 +58,55 @@ func TestNewListener(t *testing.T) {
 	trans := NewTransport()
 
 	t.Run("SuccessfulInit", func(t *testing.T) {
-		addr := "quic://127.0.0.1:9001/clean//up/"
+		for _, trans := range []*Transport{trans, NewMemTransport()} {
+			addr := trans.Scheme() + "://127.0.0.1:9001/clean//up/"
+
+			p, err := trans.NewListener(addr, sock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := p.(*listener)
+
+			// the trailing slash is kept, since it denotes a subtree route
+			if l.Path != "/clean/up/" {
+				t.Errorf("expected /clean/up/, got %s", l.Path)
+			}
+
+			if l.sock != sock {
+				t.Error("sock parameter points to unexpected location")
+			} else if l.listenMux == nil {
+				t.Error("listenMux is nil")
+			} else if l.mux != trans.mux {
+				t.Error("listener not bound to its transport's multiplexer")
+			}
+		}
+	})
+
+	t.Run("MultipleHosts", func(t *testing.T) {
+		addr := "quic://[::]:9001,0.0.0.0:9001/path"
 
 		p, err := trans.NewListener(addr, sock)
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
 		l := p.(*listener)
 
-		if l.Path != "/clean/up" {
-			t.Errorf("expected /clean/up, got %s", l.Path)
+		if l.Netloc() != "[::]:9001" {
+			t.Errorf("expected [::]:9001, got %s", l.Netloc())
+		} else if len(l.extra) != 1 || l.extra[0].Netloc() != "0.0.0.0:9001" {
+			t.Errorf("expected extra netloc 0.0.0.0:9001, got %v", l.extra)
+		} else if l.extra[0].Path != "/path" {
+			t.Errorf("expected /path, got %s", l.extra[0].Path)
+		} else if l.Address() != addr {
+			t.Errorf("expected address %s, got %s", addr, l.Address())
 		}
 
-		if l.sock != sock {
-			t.Error("sock parameter points to unexpected location")
-		} else if l.listenMux == nil {
-			t.Error("listenMux is nil")
+		if !spansFamilies(l.netlocs()) {
+			t.Error("hosts not found to span IPv4 and IPv6")
+		}
+
+		if _, err := trans.NewListener("quic://[::]:9001,/path", sock); err == nil {
+			t.Error("should have failed due to empty host")
 		}
 	})
 
@@ -77,3 +117,260 @@ func TestNewListener(t *testing.T) {
 		}
 	})
 }
+
+func TestOptions(t *testing.T) {
+	t.Run("NegotiationTimeout", func(t *testing.T) {
+		opt := newOpt()
+
+		if d := getNegotiationTimeout(opt); d != defaultNegotiationTimeout {
+			t.Errorf("expected default of %s, got %s", defaultNegotiationTimeout, d)
+		}
+
+		if err := opt.set(OptionNegotiationTimeout, time.Second); err != nil {
+			t.Error(err)
+		} else if d := getNegotiationTimeout(opt); d != time.Second {
+			t.Errorf("expected 1s, got %s", d)
+		}
+
+		if err := opt.set(OptionNegotiationTimeout, time.Duration(-1)); err != mangos.ErrBadValue {
+			t.Errorf("expected ErrBadValue, got %v", err)
+		}
+
+		if err := opt.set(OptionNegotiationTimeout, 10); err != mangos.ErrBadValue {
+			t.Errorf("expected ErrBadValue, got %v", err)
+		}
+	})
+
+	t.Run("Discovery", func(t *testing.T) {
+		opt := newOpt()
+
+		if !getDiscovery(opt) {
+			t.Error("discovery should be enabled by default")
+		}
+
+		if err := opt.set(OptionDiscovery, false); err != nil {
+			t.Error(err)
+		} else if getDiscovery(opt) {
+			t.Error("discovery not disabled")
+		}
+
+		if err := opt.set(OptionDiscovery, "no"); err != mangos.ErrBadValue {
+			t.Errorf("expected ErrBadValue, got %v", err)
+		}
+	})
+
+	t.Run("SessionPool", func(t *testing.T) {
+		opt := newOpt()
+
+		if cfg := getPoolCfg(opt); cfg.max != 1 || cfg.policy != PolicyFill {
+			t.Errorf("unexpected default %+v", cfg)
+		}
+
+		if err := opt.set(OptionMaxSessions, 4); err != nil {
+			t.Error(err)
+		} else if err = opt.set(OptionSessionPolicy, PolicySpread); err != nil {
+			t.Error(err)
+		} else if cfg := getPoolCfg(opt); cfg.max != 4 || cfg.policy != PolicySpread {
+			t.Errorf("unexpected config %+v", cfg)
+		}
+
+		if err := opt.set(OptionMaxSessions, 0); err != mangos.ErrBadValue {
+			t.Errorf("expected ErrBadValue, got %v", err)
+		}
+
+		if err := opt.set(OptionSessionPolicy, SessionPolicy(42)); err != mangos.ErrBadValue {
+			t.Errorf("expected ErrBadValue, got %v", err)
+		}
+	})
+
+	t.Run("Backlog", func(t *testing.T) {
+		opt := newOpt()
+
+		if depth, policy := getBacklog(opt); depth != defaultBacklog || policy != BacklogReject {
+			t.Errorf("unexpected default %d, %d", depth, policy)
+		}
+
+		if err := opt.set(OptionBacklog, 0); err != mangos.ErrBadValue {
+			t.Errorf("expected ErrBadValue, got %v", err)
+		}
+
+		if err := opt.set(OptionBacklogPolicy, BacklogDropOldest); err != nil {
+			t.Error(err)
+		} else if _, policy := getBacklog(opt); policy != BacklogDropOldest {
+			t.Errorf("expected BacklogDropOldest, got %d", policy)
+		}
+	})
+
+	t.Run("HandshakeTimeout", func(t *testing.T) {
+		opt := newOpt()
+		qc := &quic.Config{HandshakeTimeout: time.Minute}
+		_ = opt.set(OptionQUICConfig, qc)
+
+		if err := opt.set(OptionHandshakeTimeout, -time.Second); err != mangos.ErrBadValue {
+			t.Errorf("expected ErrBadValue, got %v", err)
+		}
+
+		if err := opt.set(OptionHandshakeTimeout, time.Second); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, got := getQUICCfg(opt); got.HandshakeTimeout != time.Second {
+			t.Errorf("expected handshake timeout 1s, got %s", got.HandshakeTimeout)
+		} else if qc.HandshakeTimeout != time.Minute {
+			t.Error("caller's QUIC config modified")
+		}
+	})
+
+	t.Run("QUICConfig", func(t *testing.T) {
+		opt := newOpt()
+
+		if _, qc := getQUICCfg(opt); qc != nil {
+			t.Errorf("expected no QUIC config by default, got %+v", qc)
+		}
+
+		for name, v := range map[string]interface{}{
+			OptionIdleTimeout:        -time.Second,
+			OptionKeepAlive:          "yes",
+			OptionMaxIncomingStreams: 0,
+		} {
+			if err := opt.set(name, v); err != mangos.ErrBadValue {
+				t.Errorf("%s: expected ErrBadValue, got %v", name, err)
+			}
+		}
+
+		qc := &quic.Config{IdleTimeout: time.Minute, KeepAlive: true, MaxIncomingStreams: 100, MaxIncomingUniStreams: 7}
+		_ = opt.set(OptionQUICConfig, qc)
+		_ = opt.set(OptionIdleTimeout, time.Second)
+		_ = opt.set(OptionKeepAlive, false)
+		_ = opt.set(OptionMaxIncomingStreams, 10)
+
+		_, got := getQUICCfg(opt)
+		if got.IdleTimeout != time.Second || got.KeepAlive || got.MaxIncomingStreams != 10 {
+			t.Errorf("typed options not merged: %+v", got)
+		} else if got.MaxIncomingUniStreams != 7 {
+			t.Error("fields without a typed option not kept")
+		} else if qc.IdleTimeout != time.Minute || !qc.KeepAlive || qc.MaxIncomingStreams != 100 {
+			t.Error("caller's QUIC config modified")
+		}
+	})
+
+	t.Run("SharedSocket", func(t *testing.T) {
+		opt := newOpt()
+
+		if getSharedSocket(opt) || getLocalAddr(opt) != "" {
+			t.Error("shared socket enabled by default")
+		}
+
+		if err := opt.set(OptionLocalAddr, "0.0.0.0"); err != mangos.ErrBadValue {
+			t.Errorf("expected ErrBadValue, got %v", err)
+		}
+
+		if err := opt.set(OptionLocalAddr, "0.0.0.0:9001"); err != nil {
+			t.Error(err)
+		} else if getLocalAddr(opt) != "0.0.0.0:9001" {
+			t.Errorf("expected 0.0.0.0:9001, got %s", getLocalAddr(opt))
+		}
+	})
+
+	t.Run("Compression", func(t *testing.T) {
+		opt := newOpt()
+
+		if err := opt.set(OptionCompression, []string{CodecFlate}); err != nil {
+			t.Error(err)
+		} else if cs := getCompression(opt); len(cs) != 1 || cs[0] != CodecFlate {
+			t.Errorf("expected [%s], got %v", CodecFlate, cs)
+		}
+
+		if err := opt.set(OptionCompression, []string{"lz4"}); err != mangos.ErrBadValue {
+			t.Errorf("expected ErrBadValue, got %v", err)
+		}
+	})
+}
+
+func TestBoundHost(t *testing.T) {
+	bound := mockAddrNetloc("[::]:54321")
+
+	for host, want := range map[string]string{
+		"127.0.0.1:0":    "127.0.0.1:54321",
+		"localhost:0":    "localhost:54321",
+		"127.0.0.1:9001": "127.0.0.1:9001",
+		"server":         "server",
+	} {
+		if got := boundHost(host, bound); got != want {
+			t.Errorf("%s: expected %s, got %s", host, want, got)
+		}
+	}
+}
+
+func TestUDPFamily(t *testing.T) {
+	for addr, want := range map[string]string{
+		"127.0.0.1:9001":  "udp4",
+		"0.0.0.0:9001":    "udp4",
+		"[::]:9001":       "udp6",
+		"[::1]:9001":      "udp6",
+		"localhost:9001":  "udp",
+		"not a host:port": "udp",
+	} {
+		if got := udpFamily(addr); got != want {
+			t.Errorf("%s: expected %s, got %s", addr, want, got)
+		}
+	}
+
+	t.Run("DualStack", func(t *testing.T) {
+		v6, err := net.ListenPacket(udpFamily("[::]:0"), "[::]:0")
+		if err != nil {
+			t.Skipf("no IPv6: %v", err)
+		}
+		defer v6.Close()
+
+		_, port, _ := net.SplitHostPort(v6.LocalAddr().String())
+		addr := net.JoinHostPort("0.0.0.0", port)
+		if v4, err := net.ListenPacket(udpFamily(addr), addr); err != nil {
+			t.Errorf("IPv4 port taken by the IPv6 wildcard: %v", err)
+		} else {
+			_ = v4.Close()
+		}
+	})
+}
+
+func TestTransportClose(t *testing.T) {
+	const netloc = mockAddrNetloc("localhost:9001")
+
+	trans := NewTransport()
+	l, sess := newMockLstn(), &mockSess{}
+
+	rfcl := newRefCntListener(netloc, l, trans.mux).Incr()
+	trans.mux.AddListener(netloc, rfcl)
+	trans.mux.AddSession(string(netloc), newRefCntSession(sess, string(netloc), trans.mux).Incr())
+	l.onClose = func() {
+		if closed, _ := sess.closeCode(); !closed {
+			t.Error("listener closed before the session went away")
+		}
+	}
+
+	if err := trans.Close(); err != nil {
+		t.Error(err)
+	} else if !l.closed || !sess.closed {
+		t.Error("listener and session should have been closed")
+	} else if sess.code != ErrorCodeGoingAway {
+		t.Errorf("expected session closed with %#x, got %#x", ErrorCodeGoingAway, sess.code)
+	}
+
+	select {
+	case <-rfcl.Done():
+	default:
+		t.Error("listener context not expired")
+	}
+
+	if _, ok := trans.mux.GetListener(netloc); ok {
+		t.Error("listener still registered")
+	} else if _, ok = trans.mux.GetSession(string(netloc)); ok {
+		t.Error("session still registered")
+	}
+
+	t.Run("Isolation", func(t *testing.T) {
+		if NewTransport().mux == trans.mux {
+			t.Error("transports share a multiplexer")
+		}
+	})
+}
@@ -6,11 +6,24 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"io"
 	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/nanomsg/mangos"
 	quic "github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/qerr"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultNegotiationTimeout = time.Second * 10
+	defaultBacklog            = 128
+	defaultReconnectTime      = time.Millisecond * 100 // as mangos sockets
 )
 
 type options struct {
@@ -18,7 +31,25 @@ type options struct {
 	opt map[string]interface{}
 }
 
-func newOpt() *options { return &options{opt: make(map[string]interface{})} }
+func newOpt() *options {
+	return &options{opt: map[string]interface{}{
+		OptionNegotiationTimeout: defaultNegotiationTimeout,
+		OptionDiscovery:          true,
+		OptionMaxSessions:        1,
+		OptionSessionPolicy:      PolicyFill,
+		OptionReverse:            false,
+		OptionBacklog:            defaultBacklog,
+		OptionBacklogPolicy:      BacklogReject,
+		OptionDrainTimeout:       time.Duration(0),
+		OptionSharedSocket:       false,
+		OptionLocalAddr:          "",
+		OptionAcceptTimeout:      time.Duration(0),
+		OptionDialTimeout:        time.Duration(0),
+		OptionHandshakeTimeout:   time.Duration(0),
+		OptionIdleTimeout:        time.Duration(0),
+		OptionMaxIncomingStreams: 0,
+	}}
+}
 
 // GetOption retrieves an option value.
 func (o *options) get(name string) (interface{}, error) {
@@ -40,6 +71,80 @@ func (o *options) set(name string, val interface{}) (err error) {
 	switch name {
 	case OptionQUICConfig, OptionTLSConfig:
 		o.opt[name] = val
+	case OptionHeaders:
+		switch h := val.(type) {
+		case Headers:
+			o.opt[name] = h
+		case map[string]string:
+			o.opt[name] = Headers(h)
+		default:
+			err = mangos.ErrBadValue
+		}
+	case OptionFallback:
+		switch fn := val.(type) {
+		case FallbackFunc:
+			o.opt[name] = fn
+		case func(string, Headers) (string, error):
+			o.opt[name] = FallbackFunc(fn)
+		default:
+			err = mangos.ErrBadValue
+		}
+	case OptionCompression:
+		cs, ok := val.([]string)
+		for _, c := range cs {
+			_, known := codecs[c]
+			ok = ok && known
+		}
+
+		if ok {
+			o.opt[name] = cs
+		} else {
+			err = mangos.ErrBadValue
+		}
+	case OptionDiscovery, OptionReverse, OptionSharedSocket, OptionKeepAlive:
+		if b, ok := val.(bool); ok {
+			o.opt[name] = b
+		} else {
+			err = mangos.ErrBadValue
+		}
+	case OptionMaxSessions, OptionBacklog, OptionMaxIncomingStreams:
+		if i, ok := val.(int); ok && i > 0 {
+			o.opt[name] = i
+		} else {
+			err = mangos.ErrBadValue
+		}
+	case OptionSessionPolicy:
+		if p, ok := val.(SessionPolicy); ok && (p == PolicyFill || p == PolicySpread) {
+			o.opt[name] = p
+		} else {
+			err = mangos.ErrBadValue
+		}
+	case OptionBacklogPolicy:
+		if p, ok := val.(BacklogPolicy); ok && (p == BacklogReject || p == BacklogDropOldest) {
+			o.opt[name] = p
+		} else {
+			err = mangos.ErrBadValue
+		}
+	case OptionLocalAddr:
+		s, ok := val.(string)
+		if ok && s != "" {
+			_, _, e := net.SplitHostPort(s)
+			ok = e == nil
+		}
+
+		if ok {
+			o.opt[name] = s
+		} else {
+			err = mangos.ErrBadValue
+		}
+	case OptionNegotiationTimeout, OptionDrainTimeout,
+		OptionAcceptTimeout, OptionDialTimeout, OptionHandshakeTimeout,
+		OptionIdleTimeout:
+		if d, ok := val.(time.Duration); ok && d >= 0 {
+			o.opt[name] = d
+		} else {
+			err = mangos.ErrBadValue
+		}
 	default:
 		err = mangos.ErrBadOption
 	}
@@ -79,12 +184,289 @@ func getQUICCfg(opt *options) (tc *tls.Config, qc *quic.Config) {
 		qc = v.(*quic.Config)
 	}
 
+	// Typed options override the fields of the caller's config in a copy, since
+	// the config may be shared by other sockets.
+	var (
+		c      quic.Config
+		merged bool
+	)
+	if qc != nil {
+		c = *qc
+	}
+
+	if d := getHandshakeTimeout(opt); d > 0 {
+		c.HandshakeTimeout, merged = d, true
+	}
+	if d := getIdleTimeout(opt); d > 0 {
+		c.IdleTimeout, merged = d, true
+	}
+	if ka, ok := getKeepAlive(opt); ok {
+		c.KeepAlive, merged = ka, true
+	}
+	if n := getMaxIncomingStreams(opt); n > 0 {
+		c.MaxIncomingStreams, merged = n, true
+	}
+
+	if merged {
+		qc = &c
+	}
 	return
 }
 
+func getHeaders(opt *options) (h Headers) {
+	if v, err := opt.get(OptionHeaders); err == nil {
+		h = v.(Headers)
+	}
+	return
+}
+
+func getFallback(opt *options) (fn FallbackFunc) {
+	if v, err := opt.get(OptionFallback); err == nil {
+		fn = v.(FallbackFunc)
+	}
+	return
+}
+
+func getCompression(opt *options) (cs []string) {
+	if v, err := opt.get(OptionCompression); err == nil {
+		cs = v.([]string)
+	}
+	return
+}
+
+func getDiscovery(opt *options) bool {
+	v, _ := opt.get(OptionDiscovery)
+	return v.(bool)
+}
+
+func getReverse(opt *options) bool {
+	v, _ := opt.get(OptionReverse)
+	return v.(bool)
+}
+
+func getBacklog(opt *options) (int, BacklogPolicy) {
+	depth, _ := opt.get(OptionBacklog)
+	policy, _ := opt.get(OptionBacklogPolicy)
+	return depth.(int), policy.(BacklogPolicy)
+}
+
+func getPoolCfg(opt *options) poolCfg {
+	max, _ := opt.get(OptionMaxSessions)
+	policy, _ := opt.get(OptionSessionPolicy)
+	return poolCfg{max: max.(int), policy: policy.(SessionPolicy)}
+}
+
+func getSharedSocket(opt *options) bool {
+	v, _ := opt.get(OptionSharedSocket)
+	return v.(bool)
+}
+
+func getLocalAddr(opt *options) string {
+	v, _ := opt.get(OptionLocalAddr)
+	return v.(string)
+}
+
+func getAcceptTimeout(opt *options) time.Duration {
+	v, _ := opt.get(OptionAcceptTimeout)
+	return v.(time.Duration)
+}
+
+func getDialTimeout(opt *options) time.Duration {
+	v, _ := opt.get(OptionDialTimeout)
+	return v.(time.Duration)
+}
+
+func getHandshakeTimeout(opt *options) time.Duration {
+	v, _ := opt.get(OptionHandshakeTimeout)
+	return v.(time.Duration)
+}
+
+func getIdleTimeout(opt *options) time.Duration {
+	v, _ := opt.get(OptionIdleTimeout)
+	return v.(time.Duration)
+}
+
+// getKeepAlive returns the keepalive setting, and whether it was set at all
+func getKeepAlive(opt *options) (ka bool, ok bool) {
+	if v, err := opt.get(OptionKeepAlive); err == nil {
+		ka, ok = v.(bool), true
+	}
+	return
+}
+
+func getMaxIncomingStreams(opt *options) int {
+	v, _ := opt.get(OptionMaxIncomingStreams)
+	return v.(int)
+}
+
+func getNegotiationTimeout(opt *options) time.Duration {
+	v, _ := opt.get(OptionNegotiationTimeout)
+	return v.(time.Duration)
+}
+
+// isTimeout reports whether err was caused by an expired deadline
+func isTimeout(err error) bool {
+	ne, ok := errors.Cause(err).(net.Error)
+	return ok && ne.Timeout()
+}
+
+func getDrainTimeout(opt *options) time.Duration {
+	v, _ := opt.get(OptionDrainTimeout)
+	return v.(time.Duration)
+}
+
+// isGoingAway reports whether err was caused by the peer closing the session
+// with ErrorCodeGoingAway, which quic-go reports as a *qerr.QuicError
+func isGoingAway(err error) bool {
+	qe, ok := errors.Cause(err).(*qerr.QuicError)
+	return ok && qe.ErrorCode == qerr.ErrorCode(ErrorCodeGoingAway)
+}
+
+// isSaturated reports whether err was returned by a session that has no stream
+// to spare, i.e. a temporary error that is not a timeout
+func isSaturated(err error) bool {
+	ne, ok := errors.Cause(err).(net.Error)
+	return ok && ne.Temporary() && !ne.Timeout()
+}
+
+// cleanPath is filepath.Clean, except that a trailing slash is preserved since
+// it denotes a subtree route.
+func cleanPath(path string) string {
+	cp := filepath.Clean(path)
+	if strings.HasSuffix(path, "/") && cp != "/" {
+		cp += "/"
+	}
+	return cp
+}
+
 type conn struct {
 	quic.Session
 	quic.Stream
+	headers Headers
+	match   routeMatch
+	peer    *spProto           // set if the SP protocols were exchanged during negotiation
+	codec   io.ReadWriteCloser // set if the stream is compressed
+}
+
+// compress wraps the stream in the named codec, if any
+func (c *conn) compress(name string) {
+	if name != "" {
+		c.codec = codecs[name](c.Stream)
+	}
 }
 
-func (c conn) Close() error { return c.Stream.Close() }
+func (c conn) Read(b []byte) (int, error) {
+	if c.codec != nil {
+		return c.codec.Read(b)
+	}
+	return c.Stream.Read(b)
+}
+
+func (c conn) Write(b []byte) (int, error) {
+	if c.codec != nil {
+		return c.codec.Write(b)
+	}
+	return c.Stream.Write(b)
+}
+
+func (c conn) Close() error {
+	if c.codec != nil {
+		return c.codec.Close()
+	}
+	return c.Stream.Close()
+}
+
+// props returns the mangos pipe properties for the connection
+func (c conn) props() []interface{} {
+	return []interface{}{
+		mangos.PropLocalAddr, c.LocalAddr(),
+		mangos.PropRemoteAddr, c.RemoteAddr(),
+		PropHeaders, c.headers,
+		PropPath, c.match.path,
+		PropRoute, c.match.pattern,
+		PropParams, c.match.params,
+		PropRemainder, c.match.remainder,
+	}
+}
+
+// splitHosts splits the comma-separated hosts of addr, which url.Parse would
+// reject.  It returns addr with its first host only, along with every host.
+func splitHosts(addr string) (string, []string) {
+	i := strings.Index(addr, "://")
+	if i < 0 {
+		return addr, []string{""}
+	}
+
+	rest := addr[i+3:]
+	end := strings.IndexAny(rest, "/?#")
+	if end < 0 {
+		end = len(rest)
+	}
+
+	hosts := strings.Split(rest[:end], ",")
+	return addr[:i+3] + hosts[0] + rest[end:], hosts
+}
+
+// udpFamily returns the network on which to bind addr, i.e. "udp4" or "udp6"
+// for IP literals, and "udp" otherwise
+func udpFamily(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "udp"
+	}
+
+	switch ip := net.ParseIP(host); {
+	case ip == nil:
+		return "udp"
+	case ip.To4() != nil:
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// spansFamilies reports whether ns hold both IPv4 and IPv6 literals
+func spansFamilies(ns []netloc) bool {
+	var v4, v6 bool
+	for _, n := range ns {
+		switch udpFamily(n.Netloc()) {
+		case "udp4":
+			v4 = true
+		case "udp6":
+			v6 = true
+		}
+	}
+	return v4 && v6
+}
+
+// boundHost returns host with the port of bound in place of an ephemeral one,
+// i.e. port 0.  The host part is left as requested, e.g. 0.0.0.0 or localhost.
+func boundHost(host string, bound net.Addr) string {
+	h, port, err := net.SplitHostPort(host)
+	if err != nil || port != "0" {
+		return host
+	}
+
+	_, p, err := net.SplitHostPort(bound.String())
+	if err != nil {
+		return host
+	}
+	return net.JoinHostPort(h, p)
+}
+
+// reconnectTimes returns the backoff with which sock redials, i.e. its
+// OptionReconnectTime and OptionMaxReconnectTime.  A zero max keeps the delay
+// constant.
+func reconnectTimes(sock mangos.Socket) (min, max time.Duration) {
+	min = defaultReconnectTime
+	if sock == nil {
+		return
+	}
+
+	if v, err := sock.GetOption(mangos.OptionReconnectTime); err == nil {
+		min = v.(time.Duration)
+	}
+	if v, err := sock.GetOption(mangos.OptionMaxReconnectTime); err == nil {
+		max = v.(time.Duration)
+	}
+	return
+}